@@ -0,0 +1,606 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// BGP session defaults
+const (
+	BGPPort             = "179"
+	DefaultBGPHoldTime  = 90 * time.Second
+	BGPConnectTimeout   = 10 * time.Second
+	BGPConnectRetry     = 30 * time.Second
+	bgpOpenHoldTime     = 4 * time.Minute // waiting for OPEN (RFC 4271 suggestion)
+	bgpMaxMessageLength = 4096
+	bgpHeaderLength     = 19
+	bgpASTrans          = 23456
+)
+
+// BGP message types
+const (
+	bgpOpen         = 1
+	bgpUpdate       = 2
+	bgpNotification = 3
+	bgpKeepalive    = 4
+)
+
+// BGP path attributes
+const (
+	bgpAttrOrigin      = 1
+	bgpAttrASPath      = 2
+	bgpAttrNextHop     = 3
+	bgpAttrLocalPref   = 5
+	bgpAttrCommunities = 8
+
+	bgpFlagOptional   = 0x80
+	bgpFlagTransitive = 0x40
+	bgpFlagExtended   = 0x10
+
+	bgpOriginIncomplete = 2
+	bgpASSequence       = 2
+	bgpCapabilityAS4    = 65
+	bgpDefaultLocalPref = 100
+)
+
+// bgpAttributes are path attributes of announced routes
+type bgpAttributes struct {
+	nextHop     net.IP
+	communities []uint32
+}
+
+type bgpRoute struct {
+	dst   *net.IPNet
+	attrs *bgpAttributes
+}
+
+func (speaker *BGPSpeaker) init() error {
+	if len(speaker.Peer) == 0 {
+		return errors.New("peer is required")
+	}
+	if _, _, err := net.SplitHostPort(speaker.Peer); err != nil {
+		speaker.Peer = net.JoinHostPort(speaker.Peer, BGPPort)
+	}
+	if speaker.LocalAS == 0 || speaker.PeerAS == 0 {
+		return errors.New("local_as and peer_as are required")
+	}
+
+	speaker.routerID = net.ParseIP(speaker.RouterID).To4()
+	if speaker.routerID == nil {
+		msg := fmt.Sprintf("router_id \"%s\" is not valid IPv4 address", speaker.RouterID)
+		return errors.New(msg)
+	}
+
+	speaker.holdTime = DefaultBGPHoldTime
+	if len(speaker.HoldTime) > 0 {
+		var err error
+		if speaker.holdTime, err = time.ParseDuration(speaker.HoldTime); err != nil {
+			msg := fmt.Sprintf("hold_time: error reading duration string \"%s\": %v", speaker.HoldTime, err)
+			return errors.New(msg)
+		}
+		if speaker.holdTime != 0 && (speaker.holdTime < 3*time.Second || speaker.holdTime > 0xffff*time.Second) {
+			return errors.New("hold_time must be 0, or 3s..65535s")
+		}
+	}
+
+	attrs, err := parseBGPAttributes(speaker.NextHop, speaker.Communities)
+	if err != nil {
+		return err
+	}
+	if attrs.nextHop == nil {
+		return errors.New("next_hop is required")
+	}
+	speaker.defaults = attrs
+
+	speaker.groups = make(map[GroupID]*bgpAttributes)
+	speaker.desired = make(map[ipstr]bgpRoute)
+	speaker.notify = make(chan struct{}, 1)
+	return nil
+}
+
+// assign group specific next hop or communities
+func (speaker *BGPSpeaker) assign(owner GroupID, announcement *BGPAnnouncement) error {
+	attrs, err := parseBGPAttributes(announcement.NextHop, announcement.Communities)
+	if err != nil {
+		return err
+	}
+	if attrs.nextHop == nil {
+		attrs.nextHop = speaker.defaults.nextHop
+	}
+	if announcement.Communities == nil {
+		attrs.communities = speaker.defaults.communities
+	}
+	speaker.groups[owner] = attrs
+	return nil
+}
+
+func parseBGPAttributes(nextHop string, communities []string) (*bgpAttributes, error) {
+	attrs := &bgpAttributes{}
+
+	if len(nextHop) > 0 {
+		attrs.nextHop = net.ParseIP(nextHop).To4()
+		if attrs.nextHop == nil {
+			msg := fmt.Sprintf("next_hop \"%s\" is not valid IPv4 address", nextHop)
+			return nil, errors.New(msg)
+		}
+	}
+
+	for _, community := range communities {
+		high, low, found := strings.Cut(community, ":")
+		asn, err1 := strconv.ParseUint(high, 10, 16)
+		value, err2 := strconv.ParseUint(low, 10, 16)
+		if !found || err1 != nil || err2 != nil {
+			msg := fmt.Sprintf("community \"%s\" is not in ASN:VALUE format", community)
+			return nil, errors.New(msg)
+		}
+		attrs.communities = append(attrs.communities, uint32(asn<<16|value))
+	}
+
+	return attrs, nil
+}
+
+func (attrs *bgpAttributes) equal(other *bgpAttributes) bool {
+	if !attrs.nextHop.Equal(other.nextHop) || len(attrs.communities) != len(other.communities) {
+		return false
+	}
+	for i := range attrs.communities {
+		if attrs.communities[i] != other.communities[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (attrs *bgpAttributes) String() string {
+	if len(attrs.communities) == 0 {
+		return fmt.Sprintf("next-hop %s", attrs.nextHop)
+	}
+	communities := make([]string, len(attrs.communities))
+	for i, community := range attrs.communities {
+		communities[i] = fmt.Sprintf("%d:%d", community>>16, community&0xffff)
+	}
+	return fmt.Sprintf("next-hop %s communities %s", attrs.nextHop, strings.Join(communities, " "))
+}
+
+// Export updates announcements wanted, session announces them asynchronously
+func (speaker *BGPSpeaker) Export(routes []ExportedRoute) {
+	desired := make(map[ipstr]bgpRoute, len(routes))
+	for _, route := range routes {
+		if route.Dst.IP.To4() == nil {
+			continue
+		}
+		attrs, exists := speaker.groups[route.Winner]
+		if !exists {
+			attrs = speaker.defaults
+		}
+		desired[ipstr(route.Dst.String())] = bgpRoute{dst: route.Dst, attrs: attrs}
+	}
+
+	speaker.mu.Lock()
+	speaker.desired = desired
+	speaker.mu.Unlock()
+
+	select {
+	case speaker.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Start BGP session, re-connecting on errors until Stop. Peer withdraws
+// all routes when session is closed.
+func (speaker *BGPSpeaker) Start(state *State) {
+	state.goroutine(func() {
+		for {
+			err := speaker.session(state.ctx.Done())
+			select {
+			case <-state.ctx.Done():
+				return
+			default:
+			}
+			log.Error().Msgf("BGP session with %s: %v (retry in %v)", speaker.Peer, err, BGPConnectRetry)
+
+			select {
+			case <-state.ctx.Done():
+				return
+			case <-time.After(BGPConnectRetry):
+			}
+		}
+	})
+}
+
+// session with the peer until error or Stop
+func (speaker *BGPSpeaker) session(done <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", speaker.Peer, BGPConnectTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := writeBGP(conn, bgpOpen, speaker.openMessage()); err != nil {
+		return err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(bgpOpenHoldTime)); err != nil {
+		return err
+	}
+	kind, body, err := readBGP(conn)
+	if err != nil {
+		return err
+	}
+	if kind != bgpOpen {
+		return unexpectedBGP(kind, body)
+	}
+	hold, as4, err := speaker.checkOpen(body)
+	if err != nil {
+		// OPEN message error
+		writeBGP(conn, bgpNotification, []byte{2, 0})
+		return err
+	}
+
+	if err := writeBGP(conn, bgpKeepalive, nil); err != nil {
+		return err
+	}
+	if kind, body, err = readBGP(conn); err != nil {
+		return err
+	}
+	if kind != bgpKeepalive {
+		return unexpectedBGP(kind, body)
+	}
+
+	log.Info().Msgf("BGP session with %s (AS %d) is established, hold time %v", speaker.Peer, speaker.PeerAS, hold)
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			if hold > 0 {
+				if err := conn.SetReadDeadline(time.Now().Add(hold)); err != nil {
+					errs <- err
+					return
+				}
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			kind, body, err := readBGP(conn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if kind == bgpNotification {
+				errs <- unexpectedBGP(kind, body)
+				return
+			}
+			// routes of the peer are ignored
+		}
+	}()
+
+	keepalive := make(<-chan time.Time)
+	if hold > 0 {
+		ticker := time.NewTicker(hold / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	advertised := make(map[ipstr]bgpRoute)
+	if err := speaker.sync(conn, advertised, as4); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-done:
+			// cease: administrative shutdown
+			writeBGP(conn, bgpNotification, []byte{6, 2})
+			log.Info().Msgf("BGP session with %s is closed", speaker.Peer)
+			return nil
+		case err := <-errs:
+			return err
+		case <-keepalive:
+			if err := writeBGP(conn, bgpKeepalive, nil); err != nil {
+				return err
+			}
+		case <-speaker.notify:
+			if err := speaker.sync(conn, advertised, as4); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// openMessage with 4-octet AS number capability
+func (speaker *BGPSpeaker) openMessage() []byte {
+	myAS := speaker.LocalAS
+	if myAS > 0xffff {
+		myAS = bgpASTrans
+	}
+
+	var body bytes.Buffer
+	body.WriteByte(4) // version
+	binary.Write(&body, binary.BigEndian, uint16(myAS))
+	binary.Write(&body, binary.BigEndian, uint16(speaker.holdTime/time.Second))
+	body.Write(speaker.routerID)
+
+	capabilities := []byte{
+		1, 4, 0, 1, 0, 1, // multiprotocol: IPv4 unicast
+		bgpCapabilityAS4, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(capabilities[8:], speaker.LocalAS)
+
+	body.WriteByte(byte(2 + len(capabilities)))
+	body.WriteByte(2) // optional parameter: capabilities
+	body.WriteByte(byte(len(capabilities)))
+	body.Write(capabilities)
+
+	return body.Bytes()
+}
+
+// checkOpen message of the peer, returns negotiated hold time
+// and 4-octet AS number support
+func (speaker *BGPSpeaker) checkOpen(body []byte) (time.Duration, bool, error) {
+	if len(body) < 10 || body[0] != 4 {
+		return 0, false, errors.New("unsupported OPEN message (BGP version 4 is required)")
+	}
+
+	peerAS := uint32(binary.BigEndian.Uint16(body[1:3]))
+	hold := time.Duration(binary.BigEndian.Uint16(body[3:5])) * time.Second
+	params := body[10:]
+	if len(params) > int(body[9]) {
+		params = params[:body[9]]
+	}
+
+	as4 := false
+	for len(params) >= 2 {
+		kind, length := params[0], int(params[1])
+		if len(params) < 2+length {
+			break
+		}
+		capabilities := params[2 : 2+length]
+		params = params[2+length:]
+		if kind != 2 {
+			continue
+		}
+		for len(capabilities) >= 2 {
+			code, size := capabilities[0], int(capabilities[1])
+			if len(capabilities) < 2+size {
+				break
+			}
+			if code == bgpCapabilityAS4 && size == 4 {
+				as4 = true
+				peerAS = binary.BigEndian.Uint32(capabilities[2:6])
+			}
+			capabilities = capabilities[2+size:]
+		}
+	}
+
+	if peerAS != speaker.PeerAS {
+		msg := fmt.Sprintf("peer AS %d does not match peer_as %d", peerAS, speaker.PeerAS)
+		return 0, false, errors.New(msg)
+	}
+	if !as4 && speaker.LocalAS > 0xffff {
+		return 0, false, errors.New("peer does not support 4-octet AS numbers (local_as)")
+	}
+
+	if speaker.holdTime < hold {
+		hold = speaker.holdTime
+	}
+	return hold, as4, nil
+}
+
+// sync announcements with the peer: withdraw routes gone,
+// announce new routes or routes with changed attributes
+func (speaker *BGPSpeaker) sync(conn net.Conn, advertised map[ipstr]bgpRoute, as4 bool) error {
+	speaker.mu.Lock()
+	desired := speaker.desired
+	speaker.mu.Unlock()
+
+	withdrawn := make([]*net.IPNet, 0)
+	for key, route := range advertised {
+		if _, exists := desired[key]; !exists {
+			withdrawn = append(withdrawn, route.dst)
+			delete(advertised, key)
+		}
+	}
+	sortNetworks(withdrawn)
+
+	announced := make(map[*bgpAttributes][]*net.IPNet)
+	for key, route := range desired {
+		if current, exists := advertised[key]; !exists || !current.attrs.equal(route.attrs) {
+			announced[route.attrs] = append(announced[route.attrs], route.dst)
+			advertised[key] = route
+		}
+	}
+
+	for _, dst := range withdrawn {
+		log.Info().Msgf("BGP WITHDRAW: %s", dst)
+	}
+	for len(withdrawn) > 0 {
+		var prefixes []byte
+		prefixes, withdrawn = packPrefixes(withdrawn, bgpMaxMessageLength-bgpHeaderLength-4)
+
+		body := make([]byte, 0, 4+len(prefixes))
+		body = append(body, be16(uint16(len(prefixes)))...)
+		body = append(body, prefixes...)
+		body = append(body, be16(0)...)
+		if err := writeBGP(conn, bgpUpdate, body); err != nil {
+			return err
+		}
+	}
+
+	for attrs, dsts := range announced {
+		sortNetworks(dsts)
+		for _, dst := range dsts {
+			log.Info().Msgf("BGP ANNOUNCE: %s %s", dst, attrs)
+		}
+
+		path := speaker.pathAttributes(attrs, as4)
+		for len(dsts) > 0 {
+			var nlri []byte
+			nlri, dsts = packPrefixes(dsts, bgpMaxMessageLength-bgpHeaderLength-4-len(path))
+
+			body := make([]byte, 0, 4+len(path)+len(nlri))
+			body = append(body, be16(0)...)
+			body = append(body, be16(uint16(len(path)))...)
+			body = append(body, path...)
+			body = append(body, nlri...)
+			if err := writeBGP(conn, bgpUpdate, body); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// pathAttributes of UPDATE message
+func (speaker *BGPSpeaker) pathAttributes(attrs *bgpAttributes, as4 bool) []byte {
+	var path []byte
+
+	path = appendBGPAttribute(path, bgpFlagTransitive, bgpAttrOrigin, []byte{bgpOriginIncomplete})
+
+	ibgp := speaker.LocalAS == speaker.PeerAS
+	if ibgp {
+		path = appendBGPAttribute(path, bgpFlagTransitive, bgpAttrASPath, nil)
+	} else if as4 {
+		segment := []byte{bgpASSequence, 1}
+		path = appendBGPAttribute(path, bgpFlagTransitive, bgpAttrASPath,
+			append(segment, be32(speaker.LocalAS)...))
+	} else {
+		segment := []byte{bgpASSequence, 1}
+		path = appendBGPAttribute(path, bgpFlagTransitive, bgpAttrASPath,
+			append(segment, be16(uint16(speaker.LocalAS))...))
+	}
+
+	path = appendBGPAttribute(path, bgpFlagTransitive, bgpAttrNextHop, attrs.nextHop.To4())
+
+	if ibgp {
+		path = appendBGPAttribute(path, bgpFlagTransitive, bgpAttrLocalPref, be32(bgpDefaultLocalPref))
+	}
+
+	if len(attrs.communities) > 0 {
+		communities := make([]byte, 0, 4*len(attrs.communities))
+		for _, community := range attrs.communities {
+			communities = append(communities, be32(community)...)
+		}
+		path = appendBGPAttribute(path, bgpFlagOptional|bgpFlagTransitive, bgpAttrCommunities, communities)
+	}
+
+	return path
+}
+
+func appendBGPAttribute(path []byte, flags, code byte, value []byte) []byte {
+	if len(value) > 0xff {
+		path = append(path, flags|bgpFlagExtended, code)
+		path = append(path, be16(uint16(len(value)))...)
+	} else {
+		path = append(path, flags, code, byte(len(value)))
+	}
+	return append(path, value...)
+}
+
+// packPrefixes encodes prefixes up to the size limit, returns the rest
+func packPrefixes(dsts []*net.IPNet, limit int) ([]byte, []*net.IPNet) {
+	packed := make([]byte, 0, limit)
+	for i, dst := range dsts {
+		ones, _ := dst.Mask.Size()
+		size := (ones + 7) / 8
+		if len(packed)+1+size > limit {
+			return packed, dsts[i:]
+		}
+		packed = append(packed, byte(ones))
+		packed = append(packed, dst.IP.To4()[:size]...)
+	}
+	return packed, nil
+}
+
+func writeBGP(conn net.Conn, kind byte, body []byte) error {
+	message := make([]byte, bgpHeaderLength, bgpHeaderLength+len(body))
+	for i := 0; i < 16; i++ {
+		message[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(message[16:], uint16(bgpHeaderLength+len(body)))
+	message[18] = kind
+	message = append(message, body...)
+
+	if err := conn.SetWriteDeadline(time.Now().Add(BGPConnectTimeout)); err != nil {
+		return err
+	}
+	_, err := conn.Write(message)
+	return err
+}
+
+func readBGP(conn net.Conn) (byte, []byte, error) {
+	header := make([]byte, bgpHeaderLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < bgpHeaderLength || length > bgpMaxMessageLength {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+
+	body := make([]byte, length-bgpHeaderLength)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+// unexpectedBGP message (or notification) as an error
+func unexpectedBGP(kind byte, body []byte) error {
+	if kind == bgpNotification && len(body) >= 2 {
+		msg := fmt.Sprintf("notification received: error code %d, subcode %d", body[0], body[1])
+		return errors.New(msg)
+	}
+	msg := fmt.Sprintf("unexpected message type %d", kind)
+	return errors.New(msg)
+}
+
+func be16(value uint16) []byte {
+	return []byte{byte(value >> 8), byte(value)}
+}
+
+func be32(value uint32) []byte {
+	return []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+}
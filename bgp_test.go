@@ -0,0 +1,246 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPackPrefixes(t *testing.T) {
+	dsts := parseNets(t, "10.0.0.0/8", "203.0.113.1/32", "0.0.0.0/0", "198.51.100.0/23")
+
+	packed, rest := packPrefixes(dsts, 64)
+	want := []byte{8, 10, 32, 203, 0, 113, 1, 0, 23, 198, 51, 100}
+	if !reflect.DeepEqual(packed, want) || len(rest) != 0 {
+		t.Errorf("packed %v (rest %v), want %v", packed, rest, want)
+	}
+
+	packed, rest = packPrefixes(dsts, 6) // second prefix does not fit
+	if !reflect.DeepEqual(packed, []byte{8, 10}) || len(rest) != 3 || rest[0] != dsts[1] {
+		t.Errorf("limited: packed %v, rest %v", packed, rest)
+	}
+}
+
+// bgpOpenBody of a peer with AS number, hold time and optional AS4 capability
+func bgpOpenBody(as uint16, hold uint16, as4 uint32) []byte {
+	body := []byte{4}
+	body = append(body, be16(as)...)
+	body = append(body, be16(hold)...)
+	body = append(body, 192, 0, 2, 1) // router id
+	if as4 == 0 {
+		return append(body, 0)
+	}
+	capability := append([]byte{bgpCapabilityAS4, 4}, be32(as4)...)
+	body = append(body, byte(2+len(capability)), 2, byte(len(capability)))
+	return append(body, capability...)
+}
+
+func TestCheckOpen(t *testing.T) {
+	speaker := &BGPSpeaker{LocalAS: 65001, PeerAS: 65000, holdTime: 90 * time.Second}
+	as4Speaker := &BGPSpeaker{LocalAS: 4200000001, PeerAS: 4200000000, holdTime: 90 * time.Second}
+
+	tests := []struct {
+		name    string
+		speaker *BGPSpeaker
+		body    []byte
+		hold    time.Duration
+		as4     bool
+		invalid bool
+	}{
+		{"2-octet peer", speaker, bgpOpenBody(65000, 30, 0), 30 * time.Second, false, false},
+		{"4-octet capable peer", speaker, bgpOpenBody(65000, 180, 65000), 90 * time.Second, true, false},
+		{"4-octet AS", as4Speaker, bgpOpenBody(bgpASTrans, 0, 4200000000), 0, true, false},
+		{"4-octet AS, peer without capability", as4Speaker, bgpOpenBody(bgpASTrans, 90, 0), 0, false, true},
+		{"other peer AS", speaker, bgpOpenBody(65002, 90, 0), 0, false, true},
+		{"BGP version 3", speaker, append([]byte{3}, bgpOpenBody(65000, 90, 0)[1:]...), 0, false, true},
+		{"short", speaker, []byte{4, 0}, 0, false, true},
+	}
+
+	for _, test := range tests {
+		hold, as4, err := test.speaker.checkOpen(test.body)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil || hold != test.hold || as4 != test.as4 {
+			t.Errorf("%s: hold %v, as4 %v, error %v; want %v, %v", test.name, hold, as4, err, test.hold, test.as4)
+		}
+	}
+
+	// own OPEN message is accepted by the peer
+	peer := &BGPSpeaker{LocalAS: 65000, PeerAS: 65001, holdTime: 60 * time.Second, routerID: net.IPv4(192, 0, 2, 1).To4()}
+	if hold, as4, err := speaker.checkOpen(peer.openMessage()); err != nil || hold != 60*time.Second || !as4 {
+		t.Errorf("openMessage: hold %v, as4 %v, error %v", hold, as4, err)
+	}
+}
+
+// bgpUpdate received by the peer stand-in
+type bgpUpdateMessage struct {
+	withdrawn []string
+	announced []string
+	nextHop   net.IP
+}
+
+func unpackPrefixes(packed []byte) []string {
+	var prefixes []string
+	for len(packed) > 0 {
+		ones := int(packed[0])
+		size := (ones + 7) / 8
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, packed[1:1+size])
+		prefixes = append(prefixes, fmt.Sprintf("%s/%d", ip, ones))
+		packed = packed[1+size:]
+	}
+	return prefixes
+}
+
+func parseBGPUpdate(t *testing.T, body []byte) bgpUpdateMessage {
+	var update bgpUpdateMessage
+
+	withdrawnLength := int(binary.BigEndian.Uint16(body))
+	update.withdrawn = unpackPrefixes(body[2 : 2+withdrawnLength])
+	body = body[2+withdrawnLength:]
+
+	pathLength := int(binary.BigEndian.Uint16(body))
+	path := body[2 : 2+pathLength]
+	update.announced = unpackPrefixes(body[2+pathLength:])
+
+	for len(path) > 0 {
+		flags, code := path[0], path[1]
+		length, offset := int(path[2]), 3
+		if flags&bgpFlagExtended != 0 {
+			length, offset = int(binary.BigEndian.Uint16(path[2:])), 4
+		}
+		if code == bgpAttrNextHop {
+			update.nextHop = net.IP(path[offset : offset+length])
+		}
+		path = path[offset+length:]
+	}
+	return update
+}
+
+// TestBGPPeerStandIn runs config without targets against a local peer
+// stand-in: routes are announced and withdrawn, session closed on Stop
+func TestBGPPeerStandIn(t *testing.T) {
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	var config Config
+	err = LoadConfig([]byte(fmt.Sprintf(`
+version: "1"
+default_resolver:
+  nameservers: [ 127.0.0.1 ]
+bgp:
+  peer: %s
+  local_as: 65001
+  peer_as: 65000
+  router_id: 192.0.2.2
+  next_hop: 192.0.2.2
+sources:
+  - interval: 1h
+    domains: [ example.com ]
+  - interval: 1h
+    domains: [ example.org ]
+    bgp:
+      next_hop: 192.0.2.3
+`, peer.Addr())), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := config.Expand()
+	defer state.wg.Wait()
+	defer state.Stop()
+
+	state.helper.StartExports()
+	state.bgp.Start(state)
+
+	conn, err := peer.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	expect := func(kind byte) []byte {
+		got, body, err := readBGP(conn)
+		if err != nil {
+			t.Fatalf("reading message type %d: %v", kind, err)
+		}
+		if got != kind {
+			t.Fatalf("message type %d (%v), want %d", got, body, kind)
+		}
+		return body
+	}
+
+	open := expect(bgpOpen)
+	if binary.BigEndian.Uint16(open[1:3]) != 65001 {
+		t.Errorf("OPEN with AS %d", binary.BigEndian.Uint16(open[1:3]))
+	}
+	writeBGP(conn, bgpOpen, bgpOpenBody(65000, 90, 65000))
+	writeBGP(conn, bgpKeepalive, nil)
+	expect(bgpKeepalive)
+
+	state.helper.Replace(0, parseNets(t, "203.0.113.1/32"))
+	update := parseBGPUpdate(t, expect(bgpUpdate))
+	if !reflect.DeepEqual(update.announced, []string{"203.0.113.1/32"}) || !update.nextHop.Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Errorf("announced %v via %v", update.announced, update.nextHop)
+	}
+
+	state.helper.Replace(1, parseNets(t, "198.51.100.7/32"))
+	update = parseBGPUpdate(t, expect(bgpUpdate))
+	if !reflect.DeepEqual(update.announced, []string{"198.51.100.7/32"}) || !update.nextHop.Equal(net.IPv4(192, 0, 2, 3)) {
+		t.Errorf("announced %v via %v", update.announced, update.nextHop)
+	}
+
+	state.helper.Replace(0, nil)
+	update = parseBGPUpdate(t, expect(bgpUpdate))
+	if !reflect.DeepEqual(update.withdrawn, []string{"203.0.113.1/32"}) || len(update.announced) > 0 {
+		t.Errorf("withdrawn %v, announced %v", update.withdrawn, update.announced)
+	}
+
+	state.Stop()
+	if notification := expect(bgpNotification); !reflect.DeepEqual(notification, []byte{6, 2}) {
+		t.Errorf("notification %v, want cease", notification)
+	}
+}
@@ -34,9 +34,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
@@ -80,11 +81,19 @@ func (config *Config) Expand() *State {
 		log.Fatal().Msg("default_resolver must be specified")
 	}
 
-	if len(config.Target.Name) == 0 || strings.Contains(config.Target.Name, " ") {
-		log.Fatal().Msgf("Invalid target.name (interface/link) \"%s\"", config.Target.Name)
+	if config.Target != nil {
+		if len(config.Targets) > 0 {
+			log.Fatal().Msg("target and targets options may not be used together")
+		}
+		config.Targets = map[string]*TargetConfig{DefaultTargetName: config.Target}
+	}
+	if len(config.Targets) == 0 && config.BGP == nil && len(config.Exports) == 0 {
+		log.Fatal().Msg("target (or targets) must be specified, unless routes are announced over bgp or exported")
 	}
-	if len(config.Target.Gateway) == 0 || strings.Contains(config.Target.Gateway, "/") {
-		log.Fatal().Msgf("Invalid target.gateway (IP): %s", config.Target.Gateway)
+	for name, target := range config.Targets {
+		if err := target.check(name); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
 	}
 
 	err := config.DefaultResolver.init()
@@ -101,6 +110,58 @@ func (config *Config) Expand() *State {
 		}
 	}
 
+	if config.Forwarder != nil {
+		err = config.Forwarder.init()
+		if err != nil {
+			log.Fatal().Msgf("forwarder init fail: %v", err)
+		}
+		if config.Forwarder.Resolver == nil {
+			config.Forwarder.Resolver = config.DefaultResolver
+		}
+	}
+
+	if config.Sniffer != nil {
+		err = config.Sniffer.init()
+		if err != nil {
+			log.Fatal().Msgf("sniffer init fail: %v", err)
+		}
+	}
+
+	if config.Dnstap != nil {
+		err = config.Dnstap.init()
+		if err != nil {
+			log.Fatal().Msgf("dnstap init fail: %v", err)
+		}
+	}
+
+	if config.QueryLog != nil {
+		err = config.QueryLog.init()
+		if err != nil {
+			log.Fatal().Msgf("query_log init fail: %v", err)
+		}
+	}
+
+	if config.OpenVPNPush != nil {
+		err = config.OpenVPNPush.init()
+		if err != nil {
+			log.Fatal().Msgf("openvpn_push init fail: %v", err)
+		}
+	}
+
+	for i, export := range config.Exports {
+		err = export.init()
+		if err != nil {
+			log.Fatal().Msgf("exports.%d init fail: %v", i, err)
+		}
+	}
+
+	if config.BGP != nil {
+		err = config.BGP.init()
+		if err != nil {
+			log.Fatal().Msgf("bgp init fail: %v", err)
+		}
+	}
+
 	for i := range groups {
 		groups[i].index = GroupID(i)
 		groups[i].config = config
@@ -115,13 +176,82 @@ func (config *Config) Expand() *State {
 	}
 
 	state := &State{
-		groups:  groups,
-		tickers: nil,
-		master:  make(chan *Group),
-		quit:    make(chan struct{}),
+		groups: groups,
+		master: make(chan Task),
+
+		forwarder: config.Forwarder,
+		sniffer:   config.Sniffer,
+		dnstap:    config.Dnstap,
+		queryLog:  config.QueryLog,
+
+		openvpnPush: config.OpenVPNPush,
+		exports:     config.Exports,
+		bgp:         config.BGP,
+
+		systemd: newSystemd(),
+	}
+
+	state.ctx, state.cancel = context.WithCancel(context.Background())
+
+	switch config.OnExit {
+	case "":
+		state.onExit = OnExitFlush
+	case OnExitFlush, OnExitKeep:
+		state.onExit = config.OnExit
+	default:
+		log.Fatal().Msgf("unsupported on_exit \"%s\" (use %s or %s)", config.OnExit, OnExitFlush, OnExitKeep)
+	}
+
+	state.shutdownTimeout = DefaultShutdownTimeout
+	if len(config.ShutdownTimeout) > 0 {
+		state.shutdownTimeout, err = time.ParseDuration(config.ShutdownTimeout)
+		if err != nil {
+			log.Fatal().Msgf("shutdown_timeout: error reading duration string \"%s\": %v", config.ShutdownTimeout, err)
+		}
+	}
+
+	state.initDomains()
+
+	for _, group := range groups {
+		if group.patterns > 0 && !state.learning() {
+			log.Warn().Msgf("sources.%d has %d domain patterns, which only apply to CNAME chains of resolved domains and DNS traffic observed by breath (no forwarder, sniffer, dnstap or query_log is configured)",
+				group.index, group.patterns)
+		}
+	}
+
+	targets := make(map[string]*RouteTarget, len(config.Targets))
+	for name, target := range config.Targets {
+		targets[name] = newRouteTarget(name, target)
 	}
+	linkTargets(targets, config.Targets)
 
-	state.helper.Reset(config.Target.Name, config.Target.Gateway, config.Target.Metric)
+	state.helper.Reset(targets)
+	for _, group := range groups {
+		sources := config.Sources[group.index]
+		state.helper.Assign(group.index, group.target, sources.Priority, sources.KillSwitch)
+	}
+	if config.OpenVPNPush != nil {
+		state.helper.AddExporter(config.OpenVPNPush)
+	}
+	for _, export := range config.Exports {
+		state.helper.AddExporter(export)
+	}
+	if config.BGP != nil {
+		for _, group := range groups {
+			if announcement := config.Sources[group.index].BGP; announcement != nil {
+				if err := config.BGP.assign(group.index, announcement); err != nil {
+					log.Fatal().Msgf("sources.%d.bgp: %v", group.index, err)
+				}
+			}
+		}
+		state.helper.AddExporter(config.BGP)
+	} else {
+		for i, sources := range config.Sources {
+			if sources.BGP != nil {
+				log.Warn().Msgf("sources.%d.bgp is not effective without bgp section", i)
+			}
+		}
+	}
 
 	return state
 }
@@ -0,0 +1,161 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	dns_impl "github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DnstapHandshakeTimeout is a limit for Frame Streams handshake
+	DnstapHandshakeTimeout = 5 * time.Second
+	// DnstapMaxFrameSize is the largest accepted frame (larger are discarded)
+	DnstapMaxFrameSize = 96 * 1024
+)
+
+func (listener *DnstapListener) init() error {
+	if len(listener.Socket) == 0 {
+		return errors.New("dnstap.socket path is not specified")
+	}
+
+	var err error
+	listener.grace, err = parseGrace("dnstap.grace", listener.Grace)
+
+	return err
+}
+
+// Bind Unix socket (may be activated by systemd) before any routes are
+// installed. Socket is closed on State.Stop.
+func (listener *DnstapListener) Bind(state *State) error {
+	socket := state.systemd.listener("unix", listener.Socket)
+	if socket == nil {
+		if err := os.Remove(listener.Socket); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("dnstap: unable to remove stale socket %s: %v", listener.Socket, err)
+		}
+
+		var err error
+		socket, err = net.Listen("unix", listener.Socket)
+		if err != nil {
+			return fmt.Errorf("dnstap: listen on %s fail: %v", listener.Socket, err)
+		}
+	}
+	listener.socket = socket
+
+	go func() {
+		<-state.ctx.Done()
+		socket.Close()
+	}()
+
+	return nil
+}
+
+// Start accepting resolver connections (bidirectional Frame Streams)
+// on bound socket, until State.Stop
+func (listener *DnstapListener) Start(state *State) {
+	socket := listener.socket
+	log.Info().Msgf("dnstap listening on %s", listener.Socket)
+
+	state.goroutine(func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				select {
+				case <-state.ctx.Done():
+				default:
+					log.Error().Msgf("dnstap: accept fail: %v", err)
+				}
+				return
+			}
+
+			state.goroutine(func() {
+				listener.serve(state, conn)
+			})
+		}
+	})
+}
+
+// serve single resolver connection, learning from client responses
+func (listener *DnstapListener) serve(state *State, conn net.Conn) {
+	defer conn.Close()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-state.ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	reader, err := dnstap.NewReader(conn, &dnstap.ReaderOptions{
+		Bidirectional: true,
+		Timeout:       DnstapHandshakeTimeout,
+	})
+	if err != nil {
+		log.Warn().Msgf("dnstap: handshake fail: %v", err)
+		return
+	}
+	log.Debug().Msg("dnstap: resolver connected")
+
+	decoder := dnstap.NewDecoder(reader, DnstapMaxFrameSize)
+	for {
+		var frame dnstap.Dnstap
+		if err := decoder.Decode(&frame); err != nil {
+			log.Debug().Msgf("dnstap: connection closed: %v", err)
+			return
+		}
+
+		message := frame.GetMessage()
+		if frame.GetType() != dnstap.Dnstap_MESSAGE || message.GetType() != dnstap.Message_CLIENT_RESPONSE {
+			continue
+		}
+
+		reply := new(dns_impl.Msg)
+		if err := reply.Unpack(message.GetResponseMessage()); err != nil {
+			log.Debug().Msgf("dnstap: unable to parse response: %v", err)
+			continue
+		}
+
+		state.Learn(reply, listener.grace)
+	}
+}
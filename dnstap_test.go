@@ -0,0 +1,119 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	dns_impl "github.com/miekg/dns"
+)
+
+// dnstapFrame records resolver message of the type with packed DNS message
+func dnstapFrame(t *testing.T, messageType dnstap.Message_Type, msg *dns_impl.Msg) *dnstap.Dnstap {
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &dnstap.Message{Type: messageType.Enum()}
+	if messageType == dnstap.Message_CLIENT_QUERY {
+		message.QueryMessage = packed
+	} else {
+		message.ResponseMessage = packed
+	}
+	return &dnstap.Dnstap{Type: dnstap.Dnstap_MESSAGE.Enum(), Message: message}
+}
+
+func TestDnstapReplay(t *testing.T) {
+	query := dnsReply(t, "www.example.com")
+	query.Response = false
+	cdn := dnsReply(t, "www.example.com",
+		"www.example.com. 300 IN CNAME edge.cdn.net.",
+		"edge.cdn.net. 60 IN A 203.0.113.5")
+	other := dnsReply(t, "other.org", "other.org. 60 IN A 198.51.100.1")
+	upstream := dnsReply(t, "api.example.com", "api.example.com. 60 IN A 203.0.113.7")
+
+	frames := []*dnstap.Dnstap{
+		dnstapFrame(t, dnstap.Message_CLIENT_QUERY, query),
+		dnstapFrame(t, dnstap.Message_RESOLVER_RESPONSE, upstream), // not client response
+		dnstapFrame(t, dnstap.Message_CLIENT_RESPONSE, cdn),
+		dnstapFrame(t, dnstap.Message_CLIENT_RESPONSE, other),
+	}
+
+	state := newTestState(t, []string{"www.example.com", "api.example.com"}, []string{"*.cdn.net"})
+	listener := &DnstapListener{Socket: filepath.Join(t.TempDir(), "dnstap.sock")}
+	if err := listener.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := listener.Bind(state); err != nil {
+		t.Fatal(err)
+	}
+	listener.Start(state)
+	defer state.wg.Wait()
+	defer state.Stop()
+
+	conn, err := net.Dial("unix", listener.Socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := dnstap.NewWriter(conn, &dnstap.WriterOptions{Bidirectional: true, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := dnstap.NewEncoder(writer)
+	for _, frame := range frames {
+		if err := encoder.Encode(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	want := map[string][]GroupID{"203.0.113.5/32": {0, 1}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := learnedRoutes(state)
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("learned %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
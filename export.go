@@ -0,0 +1,365 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Export formats
+const (
+	ExportRouterOS = "routeros"
+	ExportUCI      = "uci"
+	ExportPF       = "pf"
+)
+
+// Export modes
+const (
+	ExportSnapshot    = "snapshot"
+	ExportIncremental = "incremental"
+)
+
+// exportFormat renders full route set, or changes since previous export
+type exportFormat interface {
+	snapshot(out *bytes.Buffer, routes []ExportedRoute)
+	changes(out *bytes.Buffer, added []ExportedRoute, removed []*net.IPNet)
+}
+
+func (export *RouteExport) init() error {
+	switch export.Format {
+	case ExportRouterOS:
+		if len(export.Gateway) == 0 || strings.ContainsAny(export.Gateway, " \"") {
+			msg := fmt.Sprintf("invalid gateway \"%s\" (IP or interface name) for %s", export.Gateway, export.Format)
+			return errors.New(msg)
+		}
+		export.format = routerosFormat{gateway: export.Gateway}
+	case ExportUCI:
+		if len(export.Interface) == 0 || strings.ContainsAny(export.Interface, " '") {
+			msg := fmt.Sprintf("invalid interface \"%s\" (logical interface) for %s", export.Interface, export.Format)
+			return errors.New(msg)
+		}
+		if len(export.Gateway) > 0 && net.ParseIP(export.Gateway) == nil {
+			msg := fmt.Sprintf("invalid gateway (IP) \"%s\" for %s", export.Gateway, export.Format)
+			return errors.New(msg)
+		}
+		export.format = uciFormat{iface: export.Interface, gateway: export.Gateway}
+	case ExportPF:
+		if len(export.Table) == 0 {
+			export.Table = "breath"
+		}
+		if strings.ContainsAny(export.Table, " <>") {
+			msg := fmt.Sprintf("invalid table name \"%s\" for %s", export.Table, export.Format)
+			return errors.New(msg)
+		}
+		export.format = pfFormat{table: export.Table}
+	default:
+		msg := fmt.Sprintf("unsupported format \"%s\" (use %s, %s or %s)",
+			export.Format, ExportRouterOS, ExportUCI, ExportPF)
+		return errors.New(msg)
+	}
+
+	switch export.Mode {
+	case "":
+		export.Mode = ExportSnapshot
+	case ExportSnapshot, ExportIncremental:
+	default:
+		msg := fmt.Sprintf("unsupported mode \"%s\" (use %s or %s)", export.Mode, ExportSnapshot, ExportIncremental)
+		return errors.New(msg)
+	}
+
+	export.previous = make(map[ipstr]*net.IPNet)
+	export.notify = make(chan struct{}, 1)
+	if export.Mode == ExportIncremental && len(export.State) > 0 {
+		if err := export.loadState(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadState reads destinations of previous run (missing file: no routes)
+func (export *RouteExport) loadState() error {
+	file, err := os.Open(export.State)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, dst, err := net.ParseCIDR(line)
+		if err != nil {
+			return fmt.Errorf("state file %s: %v", export.State, err)
+		}
+		export.previous[ipstr(dst.String())] = dst
+	}
+	return scanner.Err()
+}
+
+// Export renders the route table (written to the file or stdout in
+// background). Incremental export is rendered once per run (the first
+// export, after the initial update): changes since the previous run,
+// so that no change is lost when the consumer picks up the file between runs.
+func (export *RouteExport) Export(routes []ExportedRoute) {
+	if export.Mode == ExportIncremental && export.exported {
+		return
+	}
+
+	current := make(map[ipstr]*net.IPNet, len(routes))
+	for _, route := range routes {
+		if route.Dst.IP.To4() != nil {
+			current[ipstr(route.Dst.String())] = route.Dst
+		}
+	}
+
+	var out bytes.Buffer
+	if export.Mode == ExportSnapshot {
+		export.format.snapshot(&out, routes)
+		if bytes.Equal(out.Bytes(), export.written) {
+			return
+		}
+	} else {
+		added := make([]ExportedRoute, 0)
+		for _, route := range routes {
+			if _, exists := export.previous[ipstr(route.Dst.String())]; !exists && route.Dst.IP.To4() != nil {
+				added = append(added, route)
+			}
+		}
+		removed := make([]*net.IPNet, 0)
+		for key, dst := range export.previous {
+			if _, exists := current[key]; !exists {
+				removed = append(removed, dst)
+			}
+		}
+		sortNetworks(removed)
+		export.format.changes(&out, added, removed)
+	}
+
+	export.written = out.Bytes()
+	export.previous = current
+	export.exported = true
+
+	export.mu.Lock()
+	export.pending = out.Bytes()
+	if export.Mode == ExportIncremental && len(export.State) > 0 {
+		export.pendingState = stateContent(routes)
+	}
+	export.mu.Unlock()
+
+	select {
+	case export.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Start writing rendered exports until Stop (pending one is written on Stop)
+func (export *RouteExport) Start(state *State) {
+	state.goroutine(func() {
+		for {
+			select {
+			case <-state.ctx.Done():
+				export.write()
+				return
+			case <-export.notify:
+				export.write()
+			}
+		}
+	})
+}
+
+// write pending content to the file or stdout, and state file
+func (export *RouteExport) write() {
+	export.mu.Lock()
+	content, stateFile := export.pending, export.pendingState
+	export.pending, export.pendingState = nil, nil
+	export.mu.Unlock()
+
+	if content == nil {
+		return
+	}
+
+	var err error
+	if len(export.File) == 0 || export.File == "-" {
+		_, err = os.Stdout.Write(content)
+	} else {
+		err = writeAtomic(export.File, content)
+	}
+	if err != nil {
+		log.Error().Msgf("exports (%s): %v", export.Format, err)
+		return
+	}
+
+	if stateFile != nil {
+		if err := writeAtomic(export.State, stateFile); err != nil {
+			log.Error().Msgf("exports (%s): state file: %v", export.Format, err)
+		}
+	}
+}
+
+// stateContent lists exported destinations for the next run
+func stateContent(routes []ExportedRoute) []byte {
+	var out bytes.Buffer
+	out.WriteString("# breath: destinations of the last export\n")
+	for _, route := range routes {
+		if route.Dst.IP.To4() != nil {
+			fmt.Fprintln(&out, route.Dst)
+		}
+	}
+	return out.Bytes()
+}
+
+// routerosFormat renders MikroTik RouterOS script, routes are recognized
+// by "breath" comment
+type routerosFormat struct {
+	gateway string
+}
+
+func (format routerosFormat) snapshot(out *bytes.Buffer, routes []ExportedRoute) {
+	out.WriteString("# Generated by breath (snapshot)\n/ip route\n")
+	out.WriteString("remove [find where comment~\"^breath\"]\n")
+	format.add(out, routes)
+}
+
+func (format routerosFormat) changes(out *bytes.Buffer, added []ExportedRoute, removed []*net.IPNet) {
+	out.WriteString("# Generated by breath (changes)\n/ip route\n")
+	for _, dst := range removed {
+		fmt.Fprintf(out, "remove [find where dst-address=%s and comment~\"^breath\"]\n", dst)
+	}
+	format.add(out, added)
+}
+
+func (format routerosFormat) add(out *bytes.Buffer, routes []ExportedRoute) {
+	for _, route := range routes {
+		if route.Dst.IP.To4() != nil {
+			fmt.Fprintf(out, "add dst-address=%s gateway=%s comment=\"breath: sources %s\"\n",
+				route.Dst, format.gateway, joinOwners(route.Owners))
+		}
+	}
+}
+
+// uciFormat renders OpenWrt shell script of uci commands, routes are
+// named sections "breath_<destination>" of network config
+type uciFormat struct {
+	iface   string
+	gateway string
+}
+
+func (format uciFormat) snapshot(out *bytes.Buffer, routes []ExportedRoute) {
+	out.WriteString("#!/bin/sh\n# Generated by breath (snapshot)\n")
+	out.WriteString("for section in $(uci -q show network | sed -n 's/^network\\.\\(breath_[0-9_]*\\)=route$/\\1/p'); do\n")
+	out.WriteString("\tuci delete \"network.$section\"\ndone\n")
+	format.add(out, routes)
+	format.commit(out)
+}
+
+func (format uciFormat) changes(out *bytes.Buffer, added []ExportedRoute, removed []*net.IPNet) {
+	out.WriteString("#!/bin/sh\n# Generated by breath (changes)\n")
+	for _, dst := range removed {
+		fmt.Fprintf(out, "uci -q delete network.%s\n", uciSection(dst))
+	}
+	format.add(out, added)
+	format.commit(out)
+}
+
+func (format uciFormat) add(out *bytes.Buffer, routes []ExportedRoute) {
+	for _, route := range routes {
+		if route.Dst.IP.To4() == nil {
+			continue
+		}
+		section := "network." + uciSection(route.Dst)
+		fmt.Fprintf(out, "# sources: %s\n", joinOwners(route.Owners))
+		fmt.Fprintf(out, "uci set %s=route\n", section)
+		fmt.Fprintf(out, "uci set %s.interface='%s'\n", section, format.iface)
+		fmt.Fprintf(out, "uci set %s.target='%s'\n", section, route.Dst.IP)
+		fmt.Fprintf(out, "uci set %s.netmask='%s'\n", section, net.IP(route.Dst.Mask))
+		if len(format.gateway) > 0 {
+			fmt.Fprintf(out, "uci set %s.gateway='%s'\n", section, format.gateway)
+		}
+	}
+}
+
+func (format uciFormat) commit(out *bytes.Buffer) {
+	out.WriteString("uci commit network\n/etc/init.d/network reload\n")
+}
+
+// uciSection names route section after its destination
+func uciSection(dst *net.IPNet) string {
+	return "breath_" + strings.NewReplacer(".", "_", "/", "_").Replace(dst.String())
+}
+
+// pfFormat renders pf table file (snapshot), or pfctl commands (changes)
+type pfFormat struct {
+	table string
+}
+
+func (format pfFormat) snapshot(out *bytes.Buffer, routes []ExportedRoute) {
+	fmt.Fprintf(out, "# Generated by breath (snapshot), table <%s>\n", format.table)
+	for _, route := range routes {
+		if route.Dst.IP.To4() != nil {
+			fmt.Fprintf(out, "# sources: %s\n%s\n", joinOwners(route.Owners), route.Dst)
+		}
+	}
+}
+
+func (format pfFormat) changes(out *bytes.Buffer, added []ExportedRoute, removed []*net.IPNet) {
+	out.WriteString("#!/bin/sh\n# Generated by breath (changes)\n")
+	for _, dst := range removed {
+		fmt.Fprintf(out, "pfctl -t %s -T delete %s\n", format.table, dst)
+	}
+	for _, route := range added {
+		fmt.Fprintf(out, "# sources: %s\npfctl -t %s -T add %s\n", joinOwners(route.Owners), format.table, route.Dst)
+	}
+}
+
+// sortNetworks by address, then by prefix length
+func sortNetworks(dsts []*net.IPNet) {
+	sort.Slice(dsts, func(i, j int) bool { return lessNetwork(dsts[i], dsts[j]) })
+}
@@ -0,0 +1,137 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func exportedRoutes(t *testing.T, cidrs ...string) []ExportedRoute {
+	routes := make([]ExportedRoute, 0, len(cidrs))
+	for _, dst := range parseNets(t, cidrs...) {
+		routes = append(routes, ExportedRoute{Dst: dst, Owners: []GroupID{0}})
+	}
+	return routes
+}
+
+// exportNow renders the routes and writes them (as the background writer does)
+func exportNow(export *RouteExport, routes []ExportedRoute) {
+	export.Export(routes)
+	export.write()
+}
+
+func readExport(t *testing.T, path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestIncrementalExportBetweenRuns(t *testing.T) {
+	dir := t.TempDir()
+	newExport := func() *RouteExport {
+		export := &RouteExport{
+			Format: ExportPF,
+			Mode:   ExportIncremental,
+			File:   filepath.Join(dir, "breath.sh"),
+			State:  filepath.Join(dir, "breath.state"),
+		}
+		if err := export.init(); err != nil {
+			t.Fatal(err)
+		}
+		return export
+	}
+
+	// first run: all destinations are added, later changes wait for the next run
+	export := newExport()
+	exportNow(export, exportedRoutes(t, "203.0.113.1/32", "203.0.113.2/32"))
+	first := readExport(t, export.File)
+	exportNow(export, exportedRoutes(t, "203.0.113.2/32", "203.0.113.3/32"))
+	if got := readExport(t, export.File); got != first {
+		t.Errorf("script is rewritten within the run:\n%s", got)
+	}
+	for _, line := range []string{"-T add 203.0.113.1/32", "-T add 203.0.113.2/32"} {
+		if !strings.Contains(first, line) {
+			t.Errorf("first run script has no %q:\n%s", line, first)
+		}
+	}
+
+	// second run: changes since the first run's script
+	export = newExport()
+	exportNow(export, exportedRoutes(t, "203.0.113.2/32", "203.0.113.3/32"))
+	second := readExport(t, export.File)
+	for _, line := range []string{"-T delete 203.0.113.1/32", "-T add 203.0.113.3/32"} {
+		if !strings.Contains(second, line) {
+			t.Errorf("second run script has no %q:\n%s", line, second)
+		}
+	}
+	if strings.Contains(second, "203.0.113.2/32") {
+		t.Errorf("second run script has unchanged destination:\n%s", second)
+	}
+
+	// third run without changes: script with no commands
+	export = newExport()
+	exportNow(export, exportedRoutes(t, "203.0.113.2/32", "203.0.113.3/32"))
+	if third := readExport(t, export.File); strings.Contains(third, "pfctl") {
+		t.Errorf("third run script has commands:\n%s", third)
+	}
+}
+
+func TestSnapshotExport(t *testing.T) {
+	export := &RouteExport{Format: ExportRouterOS, Gateway: "ovpn-out1", File: filepath.Join(t.TempDir(), "breath.rsc")}
+	if err := export.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	exportNow(export, exportedRoutes(t, "203.0.113.1/32"))
+	exportNow(export, exportedRoutes(t, "203.0.113.2/32", "198.51.100.0/24"))
+
+	script := readExport(t, export.File)
+	for _, line := range []string{
+		"remove [find where comment~\"^breath\"]",
+		"add dst-address=203.0.113.2/32 gateway=ovpn-out1",
+		"add dst-address=198.51.100.0/24 gateway=ovpn-out1",
+	} {
+		if !strings.Contains(script, line) {
+			t.Errorf("snapshot has no %q:\n%s", line, script)
+		}
+	}
+	if strings.Contains(script, "203.0.113.1/32") {
+		t.Errorf("snapshot has removed destination:\n%s", script)
+	}
+}
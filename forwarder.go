@@ -0,0 +1,167 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	dns_impl "github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+func (forwarder *Forwarder) init() error {
+	if len(forwarder.Listen) == 0 {
+		return errors.New("forwarder.listen address is not specified")
+	}
+	if _, _, err := net.SplitHostPort(forwarder.Listen); err != nil {
+		msg := fmt.Sprintf("forwarder.listen \"%s\" is not valid host:port: %v", forwarder.Listen, err)
+		return errors.New(msg)
+	}
+
+	var err error
+	forwarder.grace, err = parseGrace("forwarder.grace", forwarder.Grace)
+	if err != nil {
+		return err
+	}
+
+	if forwarder.Resolver != nil {
+		if err := forwarder.Resolver.init(); err != nil {
+			return fmt.Errorf("forwarder resolver init fail: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// resolverFor picks resolver of the first group the name belongs to.
+// Other names go to forwarder resolver (default_resolver, if not set).
+func (forwarder *Forwarder) resolverFor(name string) *Resolver {
+	if owners := forwarder.state.Match(name); len(owners) > 0 {
+		return forwarder.state.groups[owners[0]].resolver
+	}
+	return forwarder.Resolver
+}
+
+// ServeDNS proxies client query and installs routes before replying
+func (forwarder *Forwarder) ServeDNS(w dns_impl.ResponseWriter, req *dns_impl.Msg) {
+	if len(req.Question) != 1 {
+		dns_impl.HandleFailed(w, req)
+		return
+	}
+
+	network := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+
+	name := req.Question[0].Name
+	reply, err := forwarder.resolverFor(name).Exchange(forwarder.state.ctx, req, network)
+	if err != nil {
+		log.Warn().Msgf("FORWARD FAIL for %s from %s: %v", name, w.RemoteAddr(), err)
+		dns_impl.HandleFailed(w, req)
+		return
+	}
+
+	forwarder.state.Learn(reply, forwarder.grace)
+
+	if err := w.WriteMsg(reply); err != nil {
+		log.Debug().Msgf("Forwarder reply to %s failed: %v", w.RemoteAddr(), err)
+	}
+}
+
+// Bind UDP and TCP sockets (socket-activated by systemd, if passed),
+// before any routes are installed
+func (forwarder *Forwarder) Bind(state *State) error {
+	forwarder.state = state
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns_impl.Server{
+			Addr:    forwarder.Listen,
+			Net:     network,
+			Handler: forwarder,
+		}
+
+		var err error
+		if network == "udp" {
+			server.PacketConn = state.systemd.packetConn(network, forwarder.Listen)
+			if server.PacketConn == nil {
+				server.PacketConn, err = net.ListenPacket(network, forwarder.Listen)
+			}
+		} else {
+			server.Listener = state.systemd.listener(network, forwarder.Listen)
+			if server.Listener == nil {
+				server.Listener, err = net.Listen(network, forwarder.Listen)
+			}
+		}
+		if err != nil {
+			forwarder.Shutdown()
+			return fmt.Errorf("DNS forwarder %s/%s: %v", forwarder.Listen, network, err)
+		}
+		forwarder.servers = append(forwarder.servers, server)
+	}
+	return nil
+}
+
+// Start serving on bound sockets. Serving failure stops the State.
+func (forwarder *Forwarder) Start(state *State) {
+	for _, server := range forwarder.servers {
+		server := server
+		state.goroutine(func() {
+			log.Info().Msgf("DNS forwarder listening on %s/%s", server.Addr, server.Net)
+			err := server.ActivateAndServe()
+			if err != nil && state.ctx.Err() == nil {
+				log.Error().Msgf("DNS forwarder %s/%s fail: %v, finishing", server.Addr, server.Net, err)
+				state.Stop()
+			}
+		})
+	}
+}
+
+// Shutdown listeners. Sockets are closed as well, so that servers not
+// started yet return immediately.
+func (forwarder *Forwarder) Shutdown() {
+	for _, server := range forwarder.servers {
+		if err := server.Shutdown(); err != nil {
+			log.Debug().Msgf("DNS forwarder %s/%s shutdown: %v", server.Addr, server.Net, err)
+		}
+		if server.PacketConn != nil {
+			server.PacketConn.Close()
+		}
+		if server.Listener != nil {
+			server.Listener.Close()
+		}
+	}
+	forwarder.servers = nil
+}
@@ -0,0 +1,93 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	dns_impl "github.com/miekg/dns"
+)
+
+// replyRecorder is client side of forwarded query: [written] checks
+// state of routes when reply is written
+type replyRecorder struct {
+	dns_impl.ResponseWriter
+	written func(reply *dns_impl.Msg)
+	reply   *dns_impl.Msg
+}
+
+func (recorder *replyRecorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5353}
+}
+
+func (recorder *replyRecorder) WriteMsg(reply *dns_impl.Msg) error {
+	recorder.written(reply)
+	recorder.reply = reply
+	return nil
+}
+
+func TestForwarderRoutesBeforeReply(t *testing.T) {
+	nameserverStandIn(t, "127.0.0.21", 0, "60 IN A 203.0.113.1")
+	resolver := newTestResolver(t, StrategyFirst, "127.0.0.21")
+
+	state := newTestState(t, []string{"example.com"})
+	target := newTestTarget(t, "test", 100)
+	state.helper.Reset(map[string]*RouteTarget{"test": target})
+	state.helper.Assign(0, "test", 0, KillSwitchOff)
+	state.groups[0].resolver = resolver
+
+	forwarder := &Forwarder{Resolver: resolver, state: state}
+	recorder := &replyRecorder{written: func(reply *dns_impl.Msg) {
+		if protocol, exists := kernelRoutes(t, target)["203.0.113.1/32"]; !exists || protocol != RouteProtocol {
+			t.Errorf("route is not installed when client gets the reply")
+		}
+	}}
+
+	query := new(dns_impl.Msg)
+	query.SetQuestion("example.com.", dns_impl.TypeA)
+	forwarder.ServeDNS(recorder, query)
+
+	if recorder.reply == nil || len(recorder.reply.Answer) != 1 {
+		t.Fatalf("reply %v, want answer of the upstream", recorder.reply)
+	}
+
+	// names of no group are forwarded without routes
+	query.SetQuestion("other.org.", dns_impl.TypeA)
+	recorder.written = func(*dns_impl.Msg) {}
+	forwarder.ServeDNS(recorder, query)
+	if routes := kernelRoutes(t, target); len(routes) != 1 {
+		t.Errorf("routes %v, want the route of the group only", routes)
+	}
+}
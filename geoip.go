@@ -0,0 +1,182 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoipRecord is the subset of a GeoIP2/GeoLite2 Country record we need
+type geoipRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+var allIPv4 = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+
+func (source *GeoIPSource) init() error {
+	if len(source.Database) == 0 {
+		return errors.New("geoip.database is not specified")
+	}
+	if len(source.Countries) == 0 {
+		return errors.New("geoip.countries list is empty")
+	}
+
+	for i, country := range source.Countries {
+		if len(country) != 2 {
+			msg := fmt.Sprintf("geoip.countries: \"%s\" is not ISO 3166-1 alpha-2 code", country)
+			return errors.New(msg)
+		}
+		source.Countries[i] = strings.ToUpper(country)
+	}
+
+	return nil
+}
+
+func (source *GeoIPSource) matches(country string) bool {
+	found := false
+	for _, c := range source.Countries {
+		if c == country {
+			found = true
+			break
+		}
+	}
+	return found != source.Invert
+}
+
+// Networks enumerates IPv4 networks of the configured countries.
+// Database is opened on each call, so that updated file is picked up.
+func (source *GeoIPSource) Networks() ([]*net.IPNet, error) {
+	db, err := maxminddb.Open(source.Database)
+	if err != nil {
+		return nil, fmt.Errorf("geoip database %s: %v", source.Database, err)
+	}
+	defer db.Close()
+
+	var (
+		result []*net.IPNet
+		record geoipRecord
+	)
+
+	networks := db.NetworksWithin(allIPv4, maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		record = geoipRecord{}
+		subnet, err := networks.Network(&record)
+		if err != nil {
+			return nil, fmt.Errorf("geoip database %s: %v", source.Database, err)
+		}
+		if subnet.IP.To4() == nil || !source.matches(record.Country.ISOCode) {
+			continue
+		}
+		result = append(result, subnet)
+	}
+	if err := networks.Err(); err != nil {
+		return nil, fmt.Errorf("geoip database %s: %v", source.Database, err)
+	}
+
+	if source.Aggregate {
+		result = aggregatePrefixes(result)
+	}
+
+	return result, nil
+}
+
+type prefix4 struct {
+	start uint32
+	bits  int
+}
+
+func (p prefix4) size() uint64 {
+	return 1 << uint(32-p.bits)
+}
+
+func (p prefix4) contains(o prefix4) bool {
+	return p.bits <= o.bits && uint64(o.start) >= uint64(p.start) &&
+		uint64(o.start) < uint64(p.start)+p.size()
+}
+
+// aggregatePrefixes merges adjacent and overlapping IPv4 networks into
+// the smallest equivalent list of supernets
+func aggregatePrefixes(nets []*net.IPNet) []*net.IPNet {
+	prefixes := make([]prefix4, 0, len(nets))
+	for _, n := range nets {
+		ip4 := n.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		bits, _ := n.Mask.Size()
+		prefixes = append(prefixes, prefix4{binary.BigEndian.Uint32(ip4.Mask(n.Mask)), bits})
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].start != prefixes[j].start {
+			return prefixes[i].start < prefixes[j].start
+		}
+		return prefixes[i].bits < prefixes[j].bits
+	})
+
+	stack := make([]prefix4, 0, len(prefixes))
+	for _, p := range prefixes {
+		if len(stack) > 0 && stack[len(stack)-1].contains(p) {
+			continue
+		}
+		stack = append(stack, p)
+
+		for len(stack) >= 2 {
+			a, b := stack[len(stack)-2], stack[len(stack)-1]
+			if a.bits != b.bits || a.bits == 0 ||
+				uint64(a.start)%(2*a.size()) != 0 || uint64(b.start) != uint64(a.start)+a.size() {
+				break
+			}
+			stack = stack[:len(stack)-2]
+			stack = append(stack, prefix4{a.start, a.bits - 1})
+		}
+	}
+
+	result := make([]*net.IPNet, len(stack))
+	for i, p := range stack {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, p.start)
+		result[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(p.bits, 32)}
+	}
+	return result
+}
@@ -0,0 +1,82 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func parseNets(t *testing.T, cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func TestAggregatePrefixes(t *testing.T) {
+	tests := []struct {
+		nets []string
+		want []string
+	}{
+		{nil, []string{}},
+		{[]string{"10.0.0.0/24", "10.0.1.0/24"}, []string{"10.0.0.0/23"}},
+		{[]string{"10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}}, // not aligned
+		{[]string{"10.0.0.0/8", "10.1.2.0/24", "10.255.255.255/32"}, []string{"10.0.0.0/8"}},
+		{[]string{"192.0.2.3/32", "192.0.2.2/32", "192.0.2.0/31"}, []string{"192.0.2.0/30"}},
+		{[]string{"192.0.2.0/25", "192.0.2.128/26", "192.0.2.192/26"}, []string{"192.0.2.0/24"}},
+		{[]string{"0.0.0.0/1", "128.0.0.0/1"}, []string{"0.0.0.0/0"}},
+		{[]string{"198.51.100.0/24", "198.51.100.0/24"}, []string{"198.51.100.0/24"}},
+		{[]string{"2001:db8::/32", "203.0.113.0/24"}, []string{"203.0.113.0/24"}}, // IPv6 skipped
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, n := range aggregatePrefixes(parseNets(t, test.nets...)) {
+			got = append(got, n.String())
+		}
+		if got == nil {
+			got = []string{}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("aggregatePrefixes(%v) = %v, want %v", test.nets, got, test.want)
+		}
+	}
+}
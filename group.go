@@ -35,6 +35,7 @@ package main
 
 import (
 	"net"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -55,27 +56,207 @@ func (group *Group) init() {
 		log.Info().Msgf("sources.%d interval is not set, using 1 HOUR (\"1h\") as the default", group.index)
 		group.interval = time.Hour
 	}
+
+	group.jitter = group.interval / 10
+	if len(sources.Jitter) > 0 {
+		duration, err := time.ParseDuration(sources.Jitter)
+		if err != nil || duration < 0 {
+			log.Fatal().Msgf("sources.%d: error reading jitter string \"%s\": %v", group.index, sources.Jitter, err)
+		}
+		group.jitter = duration
+	}
+
+	group.samples = 1
+	if sources.Samples > 1 {
+		group.samples = sources.Samples
+	}
+	if len(sources.SampleWindow) > 0 {
+		duration, err := time.ParseDuration(sources.SampleWindow)
+		if err != nil || duration < 0 {
+			log.Fatal().Msgf("sources.%d: error reading sample_window string \"%s\": %v", group.index, sources.SampleWindow, err)
+		}
+		group.sampleWindow = duration
+	}
+	if len(sources.Retain) > 0 {
+		duration, err := time.ParseDuration(sources.Retain)
+		if err != nil || duration < 0 {
+			log.Fatal().Msgf("sources.%d: error reading retain string \"%s\": %v", group.index, sources.Retain, err)
+		}
+		if duration > 0 && duration < group.interval {
+			log.Warn().Msgf("sources.%d: retain %s is shorter than interval %s, addresses are not retained between updates",
+				group.index, duration, group.interval)
+		}
+		group.retain = duration
+	}
+
+	group.target = sources.Target
+	if len(group.target) == 0 && len(group.config.Targets) == 0 {
+		// routes are only announced over BGP (or exported)
+		if sources.KillSwitch != KillSwitchOff {
+			log.Fatal().Msgf("sources.%d: kill_switch requires a target", group.index)
+		}
+	} else if len(group.target) == 0 {
+		if len(group.config.Targets) != 1 {
+			log.Fatal().Msgf("sources.%d: target must be specified (%d targets configured)", group.index, len(group.config.Targets))
+		}
+		for name := range group.config.Targets {
+			group.target = name
+		}
+	} else if _, exists := group.config.Targets[group.target]; !exists {
+		log.Fatal().Msgf("sources.%d: unknown target \"%s\"", group.index, group.target)
+	}
+
+	switch sources.KillSwitch {
+	case KillSwitchOff, KillSwitchBlackhole, KillSwitchUnreachable:
+	default:
+		log.Fatal().Msgf("sources.%d: unsupported kill_switch \"%s\" (use %s or %s)",
+			group.index, sources.KillSwitch, KillSwitchBlackhole, KillSwitchUnreachable)
+	}
+
+	group.resolved = make(map[string][]net.IP)
+	group.failures = make(map[string]int)
+	group.sightings = make(map[string]map[string]sighting)
+	group.rounds = make(map[string]*samplingRound)
+	group.domains = make([]string, 0, len(sources.Domains))
+	for _, domain := range sources.Domains {
+		if err := checkDomain(domain); err != nil {
+			log.Fatal().Msgf("sources.%d: %v", group.index, err)
+		}
+		if isPattern(domain) {
+			group.patterns++
+		} else {
+			group.domains = append(group.domains, domain)
+		}
+	}
+
+	if sources.GeoIP != nil {
+		if err := sources.GeoIP.init(); err != nil {
+			log.Fatal().Msgf("sources.%d: %v", group.index, err)
+		}
+	} else if len(sources.Domains) == 0 {
+		log.Fatal().Msgf("sources.%d: neither domains nor geoip are specified", group.index)
+	}
 }
 
-// Update group by adding and removing routed IPs using group domain list and resolver
+// Update group by resolving all domains (and reading GeoIP database),
+// adding and removing routed IPs
 func (group *Group) Update(state *State) {
-	sources := group.config.Sources[group.index]
-	log.Debug().Msgf("Updating sources.%d (%d domains) (DNS: %v)", group.index, len(sources.Domains), group.resolver.NameServersIP)
+	log.Debug().Msgf("Updating sources.%d (%d domains) (DNS: %v)", group.index, len(group.domains), group.resolver.NameServersIP)
 
-	routedIPs := make([]net.IP, 0)
-	for _, domain := range sources.Domains {
-		log.Debug().Msgf("RESOLVE: %s", domain)
-		ips, err := group.resolver.Resolve(domain)
-		if err != nil {
-			log.Warn().Msgf("sources.%d RESOLOVE FAIL for domain: %s: %v (skipping)", group.index, domain, err)
-			// TODO: support on_failure: "hold"
+	for _, domain := range group.domains {
+		group.resolve(state, domain, 0) // further samples are scheduled on Start
+	}
+	if group.config.Sources[group.index].GeoIP != nil {
+		group.readGeoIP()
+	}
+	group.replace(state)
+
+	log.Debug().Msgf("Updated sources.%d (%d domains), next update in %s", group.index, len(group.domains), group.interval)
+}
+
+// Tasks of the group for the scheduler: each domain, and GeoIP networks
+func (group *Group) Tasks() []Task {
+	tasks := make([]Task, 0, len(group.domains)+1)
+	for _, domain := range group.domains {
+		tasks = append(tasks, Task{Group: group, Domain: domain})
+	}
+	if group.config.Sources[group.index].GeoIP != nil {
+		tasks = append(tasks, Task{Group: group})
+	}
+	return tasks
+}
+
+// Run scheduled task: resolve the domain (or read GeoIP database)
+// and replace group routes. Failing domain is retried according to
+// resolver retry policy, further samples are scheduled as separate tasks.
+func (task Task) Run(state *State) {
+	group := task.Group
+	switch {
+	case task.Sample > 0:
+		group.resolve(state, task.Domain, task.Sample)
+	case len(task.Domain) > 0:
+		group.resolve(state, task.Domain, 0)
+		task.retry(state.scheduler)
+		task.sampleLater(state.scheduler)
+	default:
+		group.readGeoIP()
+	}
+	group.replace(state)
+}
+
+// resolve the domain (one of samples within an update), replacing its
+// addresses with answers of the update samples so far
+func (group *Group) resolve(state *State, domain string, sample int) {
+	log.Debug().Msgf("RESOLVE: %s", domain)
+	result, err := group.resolver.Resolve(state.ctx, domain)
+	if state.ctx.Err() != nil {
+		// interrupted by Stop, keep last result
+		return
+	}
+	if err != nil && sample > 0 {
+		log.Debug().Msgf("%s: sample %d/%d failed: %v", domain, sample+1, group.samples, err)
+		return
+	}
+	if err != nil {
+		delete(group.rounds, domain)
+		log.Warn().Msgf("sources.%d RESOLOVE FAIL for domain: %s: %v (skipping)", group.index, domain, err)
+		// TODO: support on_failure: "hold"
+		group.failures[domain]++
+		if retained := group.sight(domain, nil); len(retained) > 0 {
+			log.Debug().Msgf("%s: keeping %d addresses seen within %s", domain, len(retained), group.retain)
+			group.resolved[domain] = retained
 		} else {
-			log.Debug().Msgf("%s: %v", domain, ips)
-			routedIPs = append(routedIPs, ips...)
+			delete(group.resolved, domain)
 		}
+		return
+	}
+	if len(result.Chain) > 1 {
+		log.Debug().Msgf("%s: %v (CNAME chain: %s)", domain, result.IPs, strings.Join(result.Chain, " -> "))
+		// intermediate names may match patterns (or names) of groups
+		ttl := time.Duration(result.TTL)*time.Second + DefaultGrace
+		state.LearnAddresses(result.Chain[1:], result.IPs, ttl)
+	} else {
+		log.Debug().Msgf("%s: %v", domain, result.IPs)
+	}
+	if group.samples > 1 {
+		result = group.sampled(domain, sample, result)
+	}
+	group.resolved[domain] = group.sight(domain, result.IPs)
+	if retained := len(group.resolved[domain]); retained > len(result.IPs) {
+		log.Debug().Msgf("%s: routing %d addresses seen within %s", domain, retained, group.retain)
+	}
+	// samples do not reset failures: backoff goes on while only they succeed
+	if failures := group.failures[domain]; failures > 0 && sample == 0 {
+		log.Info().Msgf("sources.%d: %s is resolved after %d failures", group.index, domain, failures)
+		delete(group.failures, domain)
+	}
+}
+
+func (group *Group) readGeoIP() {
+	geoip := group.config.Sources[group.index].GeoIP
+	networks, err := geoip.Networks()
+	if err != nil {
+		// keep previous networks, database may be in the middle of an update
+		log.Warn().Msgf("sources.%d GEOIP FAIL: %v (keeping previous networks)", group.index, err)
+		return
+	}
+	log.Debug().Msgf("sources.%d geoip %v: %d networks", group.index, geoip.Countries, len(networks))
+	group.networks = networks
+}
+
+// replace group routes with last results of domains and GeoIP
+func (group *Group) replace(state *State) {
+	if state.ctx.Err() != nil {
+		return
+	}
+
+	routedIPs := make([]net.IP, 0)
+	for _, domain := range group.domains {
+		routedIPs = append(routedIPs, group.resolved[domain]...)
 	}
 
-	state.helper.Replace(group.index, routedIPs)
+	routes := hostRoutes(routedIPs)
+	routes = append(routes, group.networks...)
 
-	log.Debug().Msgf("Updated sources.%d (%d domains), next update in %s", group.index, len(sources.Domains), group.interval)
+	state.helper.Replace(group.index, routes)
 }
@@ -0,0 +1,248 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Health probe types
+const (
+	ProbeICMP = "icmp"
+	ProbeTCP  = "tcp"
+)
+
+// Health check defaults
+const (
+	DefaultProbeInterval  = 10 * time.Second
+	DefaultProbeTimeout   = 2 * time.Second
+	DefaultProbeThreshold = 3
+)
+
+var probeSeq uint32
+
+func (check *HealthCheck) init(target *TargetConfig) error {
+	switch check.Probe {
+	case "", ProbeICMP:
+		check.Probe = ProbeICMP
+		if len(check.Address) == 0 {
+			if target.Gateway == GatewayAuto {
+				// tun and WireGuard links often have no peer address (device routes)
+				return errors.New("health.address is required for icmp probe with gateway auto")
+			}
+			// probe the gateway
+			break
+		}
+		if ip := net.ParseIP(check.Address); ip == nil || ip.To4() == nil {
+			msg := fmt.Sprintf("health.address \"%s\" is not valid IPv4 address", check.Address)
+			return errors.New(msg)
+		}
+	case ProbeTCP:
+		if _, _, err := net.SplitHostPort(check.Address); err != nil {
+			msg := fmt.Sprintf("health.address \"%s\" is not valid host:port: %v", check.Address, err)
+			return errors.New(msg)
+		}
+	default:
+		msg := fmt.Sprintf("unsupported health.probe \"%s\" (use %s or %s)", check.Probe, ProbeICMP, ProbeTCP)
+		return errors.New(msg)
+	}
+
+	var err error
+
+	check.interval = DefaultProbeInterval
+	if len(check.Interval) > 0 {
+		if check.interval, err = time.ParseDuration(check.Interval); err != nil || check.interval <= 0 {
+			msg := fmt.Sprintf("health.interval: error reading positive duration string \"%s\": %v", check.Interval, err)
+			return errors.New(msg)
+		}
+	}
+
+	check.timeout = DefaultProbeTimeout
+	if len(check.Timeout) > 0 {
+		if check.timeout, err = time.ParseDuration(check.Timeout); err != nil || check.timeout <= 0 {
+			msg := fmt.Sprintf("health.timeout: error reading positive duration string \"%s\": %v", check.Timeout, err)
+			return errors.New(msg)
+		}
+	}
+
+	if check.Threshold <= 0 {
+		check.Threshold = DefaultProbeThreshold
+	}
+
+	return nil
+}
+
+// Run single probe through the link. ICMP probe with no address
+// configured is sent to the gateway.
+func (check *HealthCheck) Run(iface string, gw net.IP) error {
+	switch check.Probe {
+	case ProbeTCP:
+		return check.connectTCP(iface)
+	default:
+		address := net.ParseIP(check.Address)
+		if address == nil {
+			address = gw
+		}
+		if address == nil {
+			return errors.New("no gateway to probe (device routes), set health.address")
+		}
+		return check.pingICMP(iface, address)
+	}
+}
+
+func (check *HealthCheck) connectTCP(iface string) error {
+	dialer := net.Dialer{
+		Timeout: check.timeout,
+		Control: bindToDevice(iface),
+	}
+
+	conn, err := dialer.Dial("tcp", check.Address)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func (check *HealthCheck) pingICMP(iface string, address net.IP) error {
+	config := net.ListenConfig{Control: bindToDevice(iface)}
+	conn, err := config.ListenPacket(context.Background(), "ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(check.timeout)); err != nil {
+		return err
+	}
+
+	dst := &net.IPAddr{IP: address}
+	echo := &icmp.Echo{
+		ID:   os.Getpid() & 0xffff,
+		Seq:  int(atomic.AddUint32(&probeSeq, 1) & 0xffff),
+		Data: []byte("breath"),
+	}
+	request, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: echo}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.WriteTo(request, dst); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+
+		reply, err := icmp.ParseMessage(1, buffer[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if body, ok := reply.Body.(*icmp.Echo); ok && body.ID == echo.ID && body.Seq == echo.Seq {
+			if addr, ok := peer.(*net.IPAddr); ok && addr.IP.Equal(dst.IP) {
+				return nil
+			}
+		}
+	}
+}
+
+// report probe result, returns true if health state of the target changed
+// (after threshold of consecutive contradicting results)
+func (target *RouteTarget) report(err error) bool {
+	if (err == nil) == target.healthy {
+		target.streak = 0
+		return false
+	}
+
+	target.streak++
+	if target.streak < target.health.Threshold {
+		log.Debug().Msgf("targets.%s: probe %d/%d contradicts health state: %v",
+			target.name, target.streak, target.health.Threshold, err)
+		return false
+	}
+
+	target.streak = 0
+	return true
+}
+
+// probeTarget runs health checks of the target until Stop
+func (state *State) probeTarget(target *RouteTarget) {
+	ticker := time.NewTicker(target.health.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-state.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		gw := state.helper.Gateway(target)
+		iface := state.helper.LinkName(target)
+		if len(target.nexthops) > 0 {
+			iface = "" // multipath: probe is routed by the kernel
+		}
+		err := inNetns(target.netns, func() error {
+			return target.health.Run(iface, gw)
+		})
+		if target.report(err) {
+			address := target.health.Address
+			if len(address) == 0 {
+				address = "gateway"
+			}
+			if err != nil {
+				log.Warn().Msgf("TARGET %s is DOWN (%d failed %s probes to %s): %v",
+					target.name, target.health.Threshold, target.health.Probe, address, err)
+			} else {
+				log.Warn().Msgf("TARGET %s is UP (%d successful %s probes to %s)",
+					target.name, target.health.Threshold, target.health.Probe, address)
+			}
+			state.helper.SetHealth(target, err == nil)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthCheckInit(t *testing.T) {
+	static := &TargetConfig{Name: "tun0", Type: TargetGateway, Gateway: "10.8.0.1"}
+	auto := &TargetConfig{Name: "tun0", Type: TargetGateway, Gateway: GatewayAuto}
+
+	tests := []struct {
+		name   string
+		check  HealthCheck
+		target *TargetConfig
+		valid  bool
+	}{
+		{"icmp to gateway", HealthCheck{}, static, true},
+		{"icmp to address", HealthCheck{Address: "10.8.0.1"}, auto, true},
+		{"icmp to auto gateway", HealthCheck{}, auto, false},
+		{"tcp with auto gateway", HealthCheck{Probe: ProbeTCP, Address: "10.8.0.1:443"}, auto, true},
+		{"zero interval", HealthCheck{Interval: "0s"}, static, false},
+		{"negative interval", HealthCheck{Interval: "-10s"}, static, false},
+		{"zero timeout", HealthCheck{Timeout: "0"}, static, false},
+		{"negative timeout", HealthCheck{Timeout: "-1s"}, static, false},
+		{"unknown probe", HealthCheck{Probe: "http"}, static, false},
+	}
+
+	for _, test := range tests {
+		check := test.check
+		if err := check.init(test.target); (err == nil) != test.valid {
+			t.Errorf("%s: %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+
+	check := HealthCheck{}
+	if err := check.init(static); err != nil || check.interval != DefaultProbeInterval || check.timeout != DefaultProbeTimeout {
+		t.Errorf("defaults: interval %v, timeout %v, error %v", check.interval, check.timeout, err)
+	}
+	check = HealthCheck{Interval: "500ms", Timeout: "100ms"}
+	if err := check.init(static); err != nil || check.interval != 500*time.Millisecond || check.timeout != 100*time.Millisecond {
+		t.Errorf("interval %v, timeout %v, error %v", check.interval, check.timeout, err)
+	}
+}
+
+func TestWireGuardTargetHealthAddress(t *testing.T) {
+	config := &TargetConfig{Name: "wg0", Type: TargetWireGuard, Peer: "key", Health: &HealthCheck{}}
+	if err := config.check("wg"); err == nil {
+		t.Error("icmp probe with no address on WireGuard target (gateway auto) is accepted")
+	}
+
+	config = &TargetConfig{Name: "wg0", Type: TargetWireGuard, Peer: "key", Health: &HealthCheck{Address: "10.0.0.1"}}
+	if err := config.check("wg"); err != nil {
+		t.Error(err)
+	}
+}
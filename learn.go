@@ -0,0 +1,159 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	dns_impl "github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ExpirationInterval is a period of checking learned routes for expiration
+	ExpirationInterval = 10 * time.Second
+)
+
+// DefaultGrace is added to TTL of learned routes, when not configured
+const DefaultGrace = time.Minute
+
+// parseGrace reads grace period option, returning DefaultGrace for empty value
+func parseGrace(option, value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return DefaultGrace, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		msg := fmt.Sprintf("%s: error reading duration string \"%s\": %v", option, value, err)
+		return 0, errors.New(msg)
+	}
+
+	return duration, nil
+}
+
+// normalizeName to lower case without trailing dot
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// initDomains builds name lookup tree of all groups (names and patterns)
+func (state *State) initDomains() {
+	state.domains = newDomainTrie()
+	for _, group := range state.groups {
+		for _, domain := range group.config.Sources[group.index].Domains {
+			state.domains.Insert(domain, group.index)
+		}
+	}
+}
+
+// Match tells which groups the domain name belongs to
+func (state *State) Match(name string) []GroupID {
+	return state.domains.Match(name)
+}
+
+// learning tells if there is any source of DNS traffic to learn from
+func (state *State) learning() bool {
+	return state.forwarder != nil || state.sniffer != nil || state.dnstap != nil || state.queryLog != nil
+}
+
+// Learn installs routes from DNS reply (A records at the end of CNAME
+// chain of the question), if the question or any name in the chain belongs
+// to a group. Routes expire after minimum TTL of the chain plus grace
+// period. Returns number of learned addresses.
+func (state *State) Learn(reply *dns_impl.Msg, grace time.Duration) int {
+	if reply == nil || reply.Rcode != dns_impl.RcodeSuccess {
+		return 0
+	}
+
+	learned := 0
+	for _, question := range reply.Question {
+		result := newResolution(question.Name)
+		if err := result.follow(reply.Answer); err != nil {
+			log.Debug().Msgf("LEARN: %v", err)
+		}
+		if len(result.IPs) > 0 {
+			ttl := time.Duration(result.TTL)*time.Second + grace
+			learned += state.LearnAddresses(result.Chain, result.IPs, ttl)
+		}
+	}
+
+	return learned
+}
+
+// LearnAddresses installs routes (expiring after ttl) for addresses
+// of the names, if any of names belongs to a group
+func (state *State) LearnAddresses(names []string, ips []net.IP, ttl time.Duration) int {
+	owners := make(map[GroupID]struct{})
+	for _, name := range names {
+		for _, owner := range state.Match(name) {
+			owners[owner] = struct{}{}
+		}
+	}
+	if len(owners) == 0 {
+		return 0
+	}
+
+	learned := 0
+	for _, dst := range hostRoutes(ips) {
+		for owner := range owners {
+			log.Debug().Msgf("LEARN sources.%d: %v %s (ttl %s)", owner, names, dst.IP, ttl)
+			state.helper.Learn(owner, dst, ttl)
+		}
+		learned++
+	}
+
+	return learned
+}
+
+// expireLearned periodically removes expired learned routes until Stop
+func (state *State) expireLearned() {
+	ticker := time.NewTicker(ExpirationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if deleted := state.helper.Expire(now); deleted > 0 {
+				log.Info().Msgf("Expired %d learned routes", deleted)
+			}
+		case <-state.ctx.Done():
+			return
+		}
+	}
+}
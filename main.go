@@ -34,6 +34,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -50,7 +51,8 @@ var (
 	config Config
 )
 
-func init() {
+// loadConfig reads the config file (hard-coded path), exiting on errors
+func loadConfig() {
 	data, err := os.ReadFile(ConfigFilePath)
 	if err != nil {
 		log.Error().Msgf("Error reading file %s: %v", ConfigFilePath, err)
@@ -61,37 +63,32 @@ func init() {
 	if err != nil {
 		log.Fatal().Msgf("LoadConfig() fail: %v", err)
 	}
+
+	setupLogging(config.LogFormat)
 }
 
 func main() {
+	loadConfig()
 	log.Info().Msg("breath starts")
 
 	state := config.Expand()
 
-	state.UpdateAll()
-
-	state.Start()
-	defer state.Cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for range c {
-			log.Warn().Msg("Interruption signal, finishing")
-			state.Stop()
-		}
+		<-c
+		log.Warn().Msg("Interruption signal, finishing")
+		cancel()
+		<-c
+		log.Warn().Msg("Second interruption signal, exiting immediately")
+		os.Exit(1)
 	}()
 
-	log.Info().Msg("Entered the loop")
-
-	for {
-		group, more := <-state.GetChan()
-		if group != nil {
-			group.Update(state)
-		}
-		if !more {
-			break
-		}
+	if err := state.Run(ctx); err != nil {
+		log.Fatal().Msgf("%v", err)
 	}
 
 	log.Info().Msg("Finishing (no more tasks)")
@@ -0,0 +1,150 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Domain patterns are not resolved (polled), they apply to names observed
+// in DNS traffic only:
+//
+//	*.example.com  any name under example.com
+//	.example.com   example.com itself and any name under it
+const (
+	patternSubdomains = "*."
+	patternSuffix     = "."
+)
+
+// domainTrie is a reversed-label tree ("com" -> "example" -> "www")
+// matching exact names and suffix patterns
+type domainTrie struct {
+	children map[string]*domainTrie
+	exact    []GroupID // names equal to the node name
+	subtree  []GroupID // names strictly under the node name
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+// isPattern tells if sources domain entry is a suffix/wildcard pattern
+func isPattern(domain string) bool {
+	return strings.HasPrefix(domain, patternSubdomains) || strings.HasPrefix(domain, patternSuffix)
+}
+
+// checkDomain validates domain name or pattern syntax
+func checkDomain(domain string) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(domain, patternSubdomains), patternSuffix)
+	if len(normalizeName(name)) == 0 {
+		msg := fmt.Sprintf("empty domain name in \"%s\"", domain)
+		return errors.New(msg)
+	}
+	if strings.Contains(name, "*") {
+		msg := fmt.Sprintf("wildcard is only supported as the first label (\"*.example.com\"): \"%s\"", domain)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+func (trie *domainTrie) node(name string) *domainTrie {
+	labels := strings.Split(normalizeName(name), ".")
+
+	node := trie
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, exists := node.children[labels[i]]
+		if !exists {
+			child = newDomainTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	return node
+}
+
+// Insert domain name or pattern for the owner
+func (trie *domainTrie) Insert(domain string, owner GroupID) {
+	switch {
+	case strings.HasPrefix(domain, patternSubdomains):
+		node := trie.node(strings.TrimPrefix(domain, patternSubdomains))
+		node.subtree = appendOwner(node.subtree, owner)
+	case strings.HasPrefix(domain, patternSuffix):
+		node := trie.node(strings.TrimPrefix(domain, patternSuffix))
+		node.exact = appendOwner(node.exact, owner)
+		node.subtree = appendOwner(node.subtree, owner)
+	default:
+		node := trie.node(domain)
+		node.exact = appendOwner(node.exact, owner)
+	}
+}
+
+// Match tells owners of all names and patterns matching the name
+func (trie *domainTrie) Match(name string) []GroupID {
+	var owners []GroupID
+
+	labels := strings.Split(normalizeName(name), ".")
+
+	node := trie
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, exists := node.children[labels[i]]
+		if !exists {
+			return owners
+		}
+		node = child
+
+		if i > 0 {
+			for _, owner := range node.subtree {
+				owners = appendOwner(owners, owner)
+			}
+		}
+	}
+
+	for _, owner := range node.exact {
+		owners = appendOwner(owners, owner)
+	}
+
+	return owners
+}
+
+func appendOwner(owners []GroupID, owner GroupID) []GroupID {
+	for _, o := range owners {
+		if o == owner {
+			return owners
+		}
+	}
+	return append(owners, owner)
+}
@@ -0,0 +1,89 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDomainTrieMatch(t *testing.T) {
+	trie := newDomainTrie()
+	trie.Insert("www.example.com", 0)
+	trie.Insert("*.example.com", 1)
+	trie.Insert(".cdn.net", 2)
+	trie.Insert("Example.COM.", 3)
+	trie.Insert("*.example.com", 3)
+
+	tests := []struct {
+		name string
+		want []GroupID
+	}{
+		{"www.example.com", []GroupID{0, 1, 3}},
+		{"WWW.Example.com.", []GroupID{0, 1, 3}},
+		{"a.b.example.com", []GroupID{1, 3}},
+		{"example.com", []GroupID{3}},
+		{"com", nil},
+		{"badexample.com", nil},
+		{"cdn.net", []GroupID{2}},
+		{"edge.cdn.net", []GroupID{2}},
+		{"edge.cdn.net.example.org", nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		got := trie.Match(test.name)
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Match(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckDomain(t *testing.T) {
+	for domain, valid := range map[string]bool{
+		"example.com":     true,
+		"*.example.com":   true,
+		".example.com":    true,
+		"":                false,
+		"*.":              false,
+		"www.*.example":   false,
+		"*.*.example.com": false,
+	} {
+		if err := checkDomain(domain); (err == nil) != valid {
+			t.Errorf("checkDomain(%q) = %v, want valid %v", domain, err, valid)
+		}
+	}
+}
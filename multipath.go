@@ -0,0 +1,192 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vishvananda/netlink"
+)
+
+// MaxNexthopWeight is a limit of the kernel (weight is stored as hops - 1)
+const MaxNexthopWeight = 256
+
+// checkMultipath validates target with nexthops (instead of name and gateway)
+func (config *TargetConfig) checkMultipath(name string) error {
+	if len(config.Name) > 0 || len(config.Gateway) > 0 {
+		msg := fmt.Sprintf("targets.%s: name and gateway may not be used with nexthops", name)
+		return errors.New(msg)
+	}
+	if config.Type != TargetGateway {
+		msg := fmt.Sprintf("targets.%s: nexthops are not supported for %s target", name, config.Type)
+		return errors.New(msg)
+	}
+
+	for i, hop := range config.Nexthops {
+		if len(hop.Name) == 0 || strings.Contains(hop.Name, " ") {
+			msg := fmt.Sprintf("Invalid targets.%s.nexthops.%d.name (interface/link) \"%s\"", name, i, hop.Name)
+			return errors.New(msg)
+		}
+		if len(hop.Gateway) > 0 && (strings.Contains(hop.Gateway, "/") || net.ParseIP(hop.Gateway) == nil) {
+			msg := fmt.Sprintf("Invalid targets.%s.nexthops.%d.gateway (IP): %s", name, i, hop.Gateway)
+			return errors.New(msg)
+		}
+		if hop.Weight == 0 {
+			hop.Weight = 1
+		}
+		if hop.Weight < 1 || hop.Weight > MaxNexthopWeight {
+			msg := fmt.Sprintf("targets.%s.nexthops.%d.weight must be 1..%d", name, i, MaxNexthopWeight)
+			return errors.New(msg)
+		}
+	}
+
+	if config.Health != nil {
+		if err := config.Health.init(config); err != nil {
+			return fmt.Errorf("targets.%s: %v", name, err)
+		}
+		if config.Health.Probe == ProbeICMP && len(config.Health.Address) == 0 {
+			msg := fmt.Sprintf("targets.%s: health.address is required with nexthops", name)
+			return errors.New(msg)
+		}
+	}
+
+	return nil
+}
+
+// newNexthops looks up links of multipath target
+func (target *RouteTarget) newNexthops(config *TargetConfig) {
+	for i, hopConfig := range config.Nexthops {
+		link, err := target.handle.LinkByName(hopConfig.Name)
+		if err != nil {
+			log.Fatal().Msgf("targets.%s.nexthops.%d: link lookup fail for link/iface \"%s\": %v",
+				target.name, i, hopConfig.Name, err)
+		}
+
+		hop := &nexthop{
+			link:   link,
+			weight: hopConfig.Weight,
+			up:     linkIsUp(link),
+		}
+		if len(hopConfig.Gateway) > 0 {
+			hop.gw = net.ParseIP(hopConfig.Gateway)
+		}
+		if !hop.up {
+			log.Warn().Msgf("targets.%s: nexthop link %s is down", target.name, hopConfig.Name)
+		}
+
+		target.nexthops = append(target.nexthops, hop)
+	}
+
+	target.linkUp = target.nexthopsUp()
+}
+
+// nexthopsUp tells if multipath target has any nexthop with link up
+func (target *RouteTarget) nexthopsUp() bool {
+	for _, hop := range target.nexthops {
+		if hop.up {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNexthop on the link with the index
+func (target *RouteTarget) hasNexthop(index int) bool {
+	for _, hop := range target.nexthops {
+		if hop.link.Attrs().Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// mkMultipath makes route through nexthops with link up. With no such
+// nexthops, route has none (matches any nexthop on delete).
+func (target *RouteTarget) mkMultipath(ip *net.IPNet) netlink.Route {
+	route := netlink.Route{
+		Dst:      ip,
+		Priority: target.metric,
+		Protocol: RouteProtocol,
+	}
+
+	for _, hop := range target.nexthops {
+		if !hop.up {
+			continue
+		}
+		info := &netlink.NexthopInfo{
+			LinkIndex: hop.link.Attrs().Index,
+			Hops:      hop.weight - 1,
+			Gw:        hop.gw,
+		}
+		if hop.gw != nil {
+			info.Flags = int(netlink.FLAG_ONLINK)
+		}
+		route.MultiPath = append(route.MultiPath, info)
+	}
+
+	return route
+}
+
+// describeMultipath the way "ip route" does
+func (target *RouteTarget) describeMultipath(ip *net.IPNet) string {
+	var builder strings.Builder
+	builder.WriteString(ip.String())
+	for _, hop := range target.nexthops {
+		if !hop.up {
+			continue
+		}
+		builder.WriteString(" nexthop")
+		if hop.gw != nil {
+			fmt.Fprintf(&builder, " via %s", hop.gw)
+		}
+		fmt.Fprintf(&builder, " dev %s weight %d", hop.link.Attrs().Name, hop.weight)
+		if hop.gw != nil {
+			builder.WriteString(" onlink")
+		}
+	}
+	return builder.String()
+}
+
+// replaceRoute rewrites installed route with current nexthops
+func (target *RouteTarget) replaceRoute(ip *net.IPNet) {
+	log.Info().Msgf("ROUTE REPLACE: %s", target.describe(ip))
+	route := target.mkRoute(ip)
+	if err := target.handle.RouteReplace(&route); err != nil {
+		log.Error().Msgf("route_replace fail (%s): %v", target.describe(ip), err)
+	}
+}
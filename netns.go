@@ -0,0 +1,100 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vishvananda/netns"
+)
+
+// openNetns opens network namespace by name (ip netns, /var/run/netns)
+// or by path (e.g. /proc/<pid>/ns/net). Empty string is the current namespace.
+func openNetns(nameOrPath string) (netns.NsHandle, error) {
+	if len(nameOrPath) == 0 {
+		return netns.None(), nil
+	}
+
+	var (
+		ns  netns.NsHandle
+		err error
+	)
+
+	if strings.HasPrefix(nameOrPath, "/") {
+		ns, err = netns.GetFromPath(nameOrPath)
+	} else {
+		ns, err = netns.GetFromName(nameOrPath)
+	}
+	if err != nil {
+		return netns.None(), fmt.Errorf("network namespace \"%s\": %v", nameOrPath, err)
+	}
+
+	return ns, nil
+}
+
+// inNetns runs fn on OS thread switched to the namespace. Sockets created
+// by fn stay in the namespace. Closed (None) handle means current namespace.
+func inNetns(ns netns.NsHandle, fn func() error) error {
+	if !ns.IsOpen() {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("unable to get current network namespace: %v", err)
+	}
+	defer origin.Close()
+
+	if err := netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("unable to switch network namespace: %v", err)
+	}
+
+	err = fn()
+
+	if restoreErr := netns.Set(origin); restoreErr != nil {
+		// keep thread locked: it is terminated with the goroutine
+		log.Error().Msgf("unable to restore network namespace: %v", restoreErr)
+		return err
+	}
+	runtime.UnlockOSThread()
+
+	return err
+}
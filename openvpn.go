@@ -0,0 +1,289 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ManagementTimeout limits a session with OpenVPN management interface
+	ManagementTimeout = 5 * time.Second
+	// DefaultSignalInterval is a minimum time between signals to the server
+	DefaultSignalInterval = time.Minute
+)
+
+func (push *OpenVPNPush) init() error {
+	if len(push.File) == 0 {
+		return errors.New("file is required")
+	}
+	if info, err := os.Stat(filepath.Dir(push.File)); err != nil || !info.IsDir() {
+		msg := fmt.Sprintf("directory of file \"%s\" does not exist", push.File)
+		return errors.New(msg)
+	}
+
+	if len(push.Management) > 0 {
+		switch push.Signal {
+		case "":
+			push.Signal = "SIGUSR1"
+		case "SIGHUP", "SIGUSR1", "SIGUSR2":
+		default:
+			msg := fmt.Sprintf("unsupported signal \"%s\" (use SIGHUP, SIGUSR1 or SIGUSR2)", push.Signal)
+			return errors.New(msg)
+		}
+	}
+
+	push.signalInterval = DefaultSignalInterval
+	if len(push.SignalInterval) > 0 {
+		duration, err := time.ParseDuration(push.SignalInterval)
+		if err != nil || duration < 0 {
+			msg := fmt.Sprintf("signal_interval: error reading duration string \"%s\": %v", push.SignalInterval, err)
+			return errors.New(msg)
+		}
+		push.signalInterval = duration
+	}
+
+	push.notify = make(chan struct{}, 1)
+	return nil
+}
+
+// Export renders routed destinations, the file is written in background
+// (not to delay route changes with disk writes)
+func (push *OpenVPNPush) Export(routes []ExportedRoute) {
+	var content bytes.Buffer
+	content.WriteString("# Generated by breath, rewritten on route changes\n")
+	for _, route := range routes {
+		if route.Dst.IP.To4() == nil {
+			continue
+		}
+		fmt.Fprintf(&content, "# sources: %s\n", joinOwners(route.Owners))
+		fmt.Fprintf(&content, "push \"route %s %s\"\n", route.Dst.IP, net.IP(route.Dst.Mask))
+	}
+
+	push.mu.Lock()
+	push.pending = content.Bytes()
+	push.mu.Unlock()
+
+	select {
+	case push.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Start writing the file on changes (and signalling the server, at most
+// once per signal interval) until Stop. Pending content is written on Stop.
+func (push *OpenVPNPush) Start(state *State) {
+	state.goroutine(func() {
+		var signalled time.Time
+		for {
+			select {
+			case <-state.ctx.Done():
+				push.write()
+				return
+			case <-push.notify:
+			}
+
+			if !push.write() || len(push.Management) == 0 {
+				continue
+			}
+
+			if wait := time.Until(signalled.Add(push.signalInterval)); wait > 0 {
+				log.Debug().Msgf("openvpn_push: %s is delayed by %v", push.Signal, wait)
+				select {
+				case <-state.ctx.Done():
+					push.write()
+					return
+				case <-time.After(wait):
+				}
+				push.write() // changes within the interval go with the same signal
+			}
+
+			signalled = time.Now()
+			if err := push.signal(); err != nil {
+				log.Error().Msgf("openvpn_push: management interface %s: %v", push.Management, err)
+			} else {
+				log.Info().Msgf("openvpn_push: %s thrown to OpenVPN server", push.Signal)
+			}
+		}
+	})
+}
+
+// write pending content, if it differs from the file, tells if the file changed
+func (push *OpenVPNPush) write() bool {
+	push.mu.Lock()
+	content := push.pending
+	push.pending = nil
+	push.mu.Unlock()
+
+	if content == nil || bytes.Equal(content, push.written) {
+		return false
+	}
+	if err := writeAtomic(push.File, content); err != nil {
+		log.Error().Msgf("openvpn_push: %v", err)
+		return false
+	}
+	push.written = content
+	log.Debug().Msgf("openvpn_push: %s is updated", push.File)
+	return true
+}
+
+// signal OpenVPN server through management interface
+func (push *OpenVPNPush) signal() error {
+	network := "tcp"
+	if strings.HasPrefix(push.Management, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, push.Management, ManagementTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(ManagementTimeout)); err != nil {
+		return err
+	}
+
+	session := &managementSession{conn: conn}
+
+	line, err := session.expect("ENTER PASSWORD:", ">INFO:")
+	if err != nil {
+		return err
+	}
+	if line == "ENTER PASSWORD:" {
+		if err := session.send(push.Password); err != nil {
+			return err
+		}
+		if _, err := session.expect(">INFO:"); err != nil {
+			return err
+		}
+	}
+
+	if err := session.send("signal " + push.Signal); err != nil {
+		return err
+	}
+	if line, err = session.expect("SUCCESS:", "ERROR:"); err != nil {
+		return err
+	}
+	if strings.HasPrefix(line, "ERROR:") {
+		return errors.New(line)
+	}
+
+	return session.send("quit")
+}
+
+// managementSession reads OpenVPN management interface output line by line
+type managementSession struct {
+	conn    net.Conn
+	pending string
+}
+
+func (session *managementSession) send(command string) error {
+	_, err := session.conn.Write([]byte(command + "\n"))
+	return err
+}
+
+// expect line starting with one of prefixes, skipping others. Password
+// prompt is recognized without line ending.
+func (session *managementSession) expect(prefixes ...string) (string, error) {
+	buffer := make([]byte, 1024)
+	for {
+		for {
+			line, rest, complete := strings.Cut(session.pending, "\n")
+			if !complete {
+				if strings.HasPrefix(line, "ENTER PASSWORD:") {
+					session.pending = ""
+					return "ENTER PASSWORD:", nil
+				}
+				break
+			}
+			session.pending = rest
+
+			line = strings.TrimSuffix(line, "\r")
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(line, prefix) {
+					return line, nil
+				}
+			}
+		}
+
+		n, err := session.conn.Read(buffer)
+		if err != nil {
+			return "", err
+		}
+		session.pending += string(buffer[:n])
+	}
+}
+
+// writeAtomic replaces file content, so that readers never see partial file
+func writeAtomic(path string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// joinOwners formats group indices for comments
+func joinOwners(owners []GroupID) string {
+	parts := make([]string, len(owners))
+	for i, owner := range owners {
+		parts[i] = fmt.Sprint(int(owner))
+	}
+	return strings.Join(parts, ", ")
+}
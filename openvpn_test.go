@@ -0,0 +1,153 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// managementStandIn accepts OpenVPN management sessions, sending
+// signal commands it receives to the channel
+func managementStandIn(t *testing.T, password string) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	signals := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				conn.Write([]byte("ENTER PASSWORD:"))
+				if line, _ := reader.ReadString('\n'); strings.TrimSpace(line) != password {
+					conn.Write([]byte("ERROR: bad password\r\n"))
+					return
+				}
+				conn.Write([]byte("SUCCESS: password is correct\r\n>INFO:OpenVPN Management Interface Version 3\r\n"))
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					command := strings.TrimSpace(line)
+					if strings.HasPrefix(command, "signal ") {
+						conn.Write([]byte("SUCCESS: " + strings.TrimPrefix(command, "signal ") + " thrown\r\n"))
+						signals <- command
+					}
+				}
+			}()
+		}
+	}()
+	return listener, signals
+}
+
+func TestOpenVPNPushSignals(t *testing.T) {
+	listener, signals := managementStandIn(t, "secret")
+
+	push := &OpenVPNPush{
+		File:           filepath.Join(t.TempDir(), "laptop"),
+		Management:     listener.Addr().String(),
+		Password:       "secret",
+		SignalInterval: "300ms",
+	}
+	if err := push.init(); err != nil {
+		t.Fatal(err)
+	}
+	if push.Signal != "SIGUSR1" {
+		t.Errorf("default signal %s", push.Signal)
+	}
+
+	state := &State{systemd: &Systemd{}}
+	state.ctx, state.cancel = context.WithCancel(context.Background())
+	push.Start(state)
+
+	push.Export(exportedRoutes(t, "203.0.113.1/32"))
+	select {
+	case signal := <-signals:
+		if signal != "signal SIGUSR1" {
+			t.Errorf("command %q", signal)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no signal after the first change")
+	}
+
+	// changes within the interval are batched into one signal
+	start := time.Now()
+	push.Export(exportedRoutes(t, "203.0.113.2/32"))
+	time.Sleep(50 * time.Millisecond)
+	push.Export(exportedRoutes(t, "203.0.113.3/32"))
+	select {
+	case <-signals:
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("second signal after %v, before signal interval", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no signal after batched changes")
+	}
+	select {
+	case <-signals:
+		t.Error("batched changes are signalled twice")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	content, err := os.ReadFile(push.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `push "route 203.0.113.3 255.255.255.255"`) || strings.Contains(string(content), "203.0.113.2") {
+		t.Errorf("file content:\n%s", content)
+	}
+
+	// pending content is written on Stop
+	push.Export(exportedRoutes(t, "203.0.113.4/32"))
+	state.Stop()
+	state.wg.Wait()
+	if content, _ := os.ReadFile(push.File); !strings.Contains(string(content), "203.0.113.4") {
+		t.Errorf("file content after Stop:\n%s", content)
+	}
+}
@@ -0,0 +1,316 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Supported query log formats
+const (
+	QueryLogDnsmasq = "dnsmasq"
+	QueryLogUnbound = "unbound"
+)
+
+const (
+	// DefaultQueryLogTTL is used as record TTL, which logs do not tell
+	DefaultQueryLogTTL = 5 * time.Minute
+	// QueryLogPollInterval is a period of checking log file for new lines
+	QueryLogPollInterval = time.Second
+	// dnsmasqChainTimeout drops CNAME chains of queries with no more replies
+	dnsmasqChainTimeout = time.Minute
+)
+
+var (
+	// dnsmasq: "reply example.com is 93.184.216.34", "cached example.com is <CNAME>",
+	// with log-queries=extra: "17 192.168.1.10/52136 reply example.com is <CNAME>"
+	dnsmasqReply = regexp.MustCompile(`dnsmasq\[\d+\]: (?:(\d+) \S+ )?(?:reply|cached) (\S+) is (\S+)`)
+	dnsmasqQuery = regexp.MustCompile(`dnsmasq\[\d+\]: (?:(\d+) \S+ )?query\[`)
+	// unbound: "info: 192.168.1.10 example.com. A IN NOERROR 0.000000 0 45"
+	unboundReply = regexp.MustCompile(`info: \S+ (\S+) A IN NOERROR `)
+)
+
+func (queryLog *QueryLog) init() error {
+	if len(queryLog.Path) == 0 {
+		return errors.New("query_log.path is not specified")
+	}
+
+	switch queryLog.Format {
+	case QueryLogDnsmasq, QueryLogUnbound:
+	case "":
+		queryLog.Format = QueryLogDnsmasq
+	default:
+		msg := fmt.Sprintf("unsupported query_log.format \"%s\" (use %s or %s)", queryLog.Format, QueryLogDnsmasq, QueryLogUnbound)
+		return errors.New(msg)
+	}
+
+	var err error
+	queryLog.ttl = DefaultQueryLogTTL
+	if len(queryLog.TTL) > 0 {
+		queryLog.ttl, err = time.ParseDuration(queryLog.TTL)
+		if err != nil {
+			msg := fmt.Sprintf("query_log.ttl: error reading duration string \"%s\": %v", queryLog.TTL, err)
+			return errors.New(msg)
+		}
+	}
+
+	queryLog.grace, err = parseGrace("query_log.grace", queryLog.Grace)
+	queryLog.resolved = make(map[string]time.Time)
+
+	return err
+}
+
+// Start following log file from its end, until State.Stop
+func (queryLog *QueryLog) Start(state *State) {
+	tail := &logTail{path: queryLog.Path}
+	if err := tail.open(true); err != nil {
+		log.Warn().Msgf("query_log: %v (waiting for file)", err)
+	}
+	log.Info().Msgf("Following %s query log %s", queryLog.Format, queryLog.Path)
+
+	state.goroutine(func() {
+		defer tail.close()
+
+		ticker := time.NewTicker(QueryLogPollInterval)
+		defer ticker.Stop()
+
+		chains := make(map[string]*dnsmasqChain) // by query serial number
+		for {
+			var now time.Time
+			select {
+			case <-state.ctx.Done():
+				return
+			case now = <-ticker.C:
+			}
+
+			for _, line := range tail.lines() {
+				switch queryLog.Format {
+				case QueryLogDnsmasq:
+					queryLog.dnsmasqLine(state, line, chains, now)
+				case QueryLogUnbound:
+					queryLog.unboundLine(state, line)
+				}
+			}
+			for serial, chain := range chains {
+				if now.Sub(chain.updated) > dnsmasqChainTimeout {
+					delete(chains, serial)
+				}
+			}
+		}
+	})
+}
+
+// dnsmasqChain is CNAME names of a query preceding reply with address
+type dnsmasqChain struct {
+	names   []string
+	updated time.Time
+}
+
+// dnsmasqLine learns address from reply line. CNAME replies are followed
+// by replies for the target: names are accumulated per query, correlated
+// by serial number (log-queries=extra). Without serial numbers, lines of
+// concurrent queries can't be told apart, so replies are not chained.
+func (queryLog *QueryLog) dnsmasqLine(state *State, line string, chains map[string]*dnsmasqChain, now time.Time) {
+	if match := dnsmasqQuery.FindStringSubmatch(line); match != nil {
+		if serial := match[1]; len(serial) > 0 {
+			delete(chains, serial)
+		}
+		return
+	}
+
+	match := dnsmasqReply.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+
+	serial, name, answer := match[1], match[2], match[3]
+	chain := chains[serial]
+	if len(serial) == 0 || chain == nil {
+		chain = &dnsmasqChain{}
+	}
+
+	if answer == "<CNAME>" {
+		if len(serial) > 0 {
+			chain.names = append(chain.names, name)
+			chain.updated = now
+			chains[serial] = chain
+		}
+		return
+	}
+
+	if ip := net.ParseIP(answer); ip != nil {
+		names := append(append([]string(nil), chain.names...), name)
+		state.LearnAddresses(names, []net.IP{ip}, queryLog.ttl+queryLog.grace)
+	}
+}
+
+// unboundLine resolves name of successful reply using group resolver,
+// since unbound log-replies lines do not include answer data
+func (queryLog *QueryLog) unboundLine(state *State, line string) {
+	match := unboundReply.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+
+	name := normalizeName(match[1])
+	owners := state.Match(name)
+	if len(owners) == 0 {
+		return
+	}
+
+	now := time.Now()
+	if resolved, exists := queryLog.resolved[name]; exists && now.Sub(resolved) < queryLog.ttl/2 {
+		return
+	}
+	for cached, resolved := range queryLog.resolved {
+		if now.Sub(resolved) >= queryLog.ttl/2 {
+			delete(queryLog.resolved, cached)
+		}
+	}
+	queryLog.resolved[name] = now
+
+	result, err := state.groups[owners[0]].resolver.Resolve(state.ctx, name)
+	if err != nil {
+		log.Warn().Msgf("query_log: resolve %s fail: %v", name, err)
+		return
+	}
+
+	state.LearnAddresses(result.Chain, result.IPs, queryLog.ttl+queryLog.grace)
+}
+
+// logTail reads lines appended to the file, reopening it on rotation
+// (file replaced) and reading from the start on truncation
+type logTail struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial string
+}
+
+func (tail *logTail) open(seekEnd bool) error {
+	file, err := os.Open(tail.path)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	tail.offset = 0
+	if seekEnd {
+		tail.offset, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	tail.file, tail.info = file, info
+	tail.reader = bufio.NewReader(file)
+	tail.partial = ""
+
+	return nil
+}
+
+func (tail *logTail) close() {
+	if tail.file != nil {
+		tail.file.Close()
+		tail.file = nil
+	}
+}
+
+// lines returns complete lines appended since last call
+func (tail *logTail) lines() []string {
+	if tail.file == nil {
+		if err := tail.open(false); err != nil {
+			return nil
+		}
+		log.Info().Msgf("query_log: opened %s", tail.path)
+	}
+
+	lines := tail.read()
+
+	info, err := os.Stat(tail.path)
+	switch {
+	case err != nil:
+		// removed, keep reading old file until new one appears
+	case !os.SameFile(info, tail.info):
+		log.Info().Msgf("query_log: %s rotated", tail.path)
+		tail.close()
+		if err := tail.open(false); err == nil {
+			lines = append(lines, tail.read()...)
+		}
+	case info.Size() < tail.offset:
+		log.Info().Msgf("query_log: %s truncated", tail.path)
+		tail.close()
+		if err := tail.open(false); err == nil {
+			lines = append(lines, tail.read()...)
+		}
+	}
+
+	return lines
+}
+
+func (tail *logTail) read() []string {
+	var lines []string
+
+	for {
+		line, err := tail.reader.ReadString('\n')
+		tail.offset += int64(len(line))
+		if err != nil {
+			tail.partial += line
+			if err != io.EOF {
+				log.Error().Msgf("query_log: read %s fail: %v", tail.path, err)
+			}
+			return lines
+		}
+
+		lines = append(lines, tail.partial+line[:len(line)-1])
+		tail.partial = ""
+	}
+}
@@ -0,0 +1,93 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDnsmasqInterleavedReplies(t *testing.T) {
+	lines := []string{
+		"dnsmasq[42]: 1 192.168.1.10/52136 query[A] www.example.com from 192.168.1.10",
+		"dnsmasq[42]: 2 192.168.1.11/40211 query[A] other.org from 192.168.1.11",
+		"dnsmasq[42]: 1 192.168.1.10/52136 reply www.example.com is <CNAME>",
+		"dnsmasq[42]: 2 192.168.1.11/40211 reply other.org is <CNAME>",
+		"dnsmasq[42]: 2 192.168.1.11/40211 reply other.cdn.net is 203.0.113.2",
+		"dnsmasq[42]: 1 192.168.1.10/52136 reply edge.cdn.net is 203.0.113.1",
+		"dnsmasq[42]: 3 192.168.1.12/33000 query[A] www.example.com from 192.168.1.12",
+		"dnsmasq[42]: 3 192.168.1.12/33000 cached www.example.com is 203.0.113.3",
+	}
+
+	state := newTestState(t, []string{"www.example.com"})
+	queryLog := &QueryLog{Format: QueryLogDnsmasq, ttl: time.Minute}
+	chains := make(map[string]*dnsmasqChain)
+	for _, line := range lines {
+		queryLog.dnsmasqLine(state, line, chains, time.Now())
+	}
+
+	want := map[string][]GroupID{
+		"203.0.113.1/32": {0},
+		"203.0.113.3/32": {0},
+	}
+	if got := learnedRoutes(state); !reflect.DeepEqual(got, want) {
+		t.Errorf("learned %v, want %v", got, want)
+	}
+}
+
+func TestDnsmasqRepliesWithoutSerial(t *testing.T) {
+	lines := []string{
+		"dnsmasq[42]: query[A] www.example.com from 192.168.1.10",
+		"dnsmasq[42]: query[A] other.org from 192.168.1.11",
+		"dnsmasq[42]: reply www.example.com is <CNAME>",
+		"dnsmasq[42]: reply other.cdn.net is 203.0.113.2",
+		"dnsmasq[42]: reply www.example.com is 203.0.113.3",
+	}
+
+	state := newTestState(t, []string{"www.example.com"})
+	queryLog := &QueryLog{Format: QueryLogDnsmasq, ttl: time.Minute}
+	chains := make(map[string]*dnsmasqChain)
+	for _, line := range lines {
+		queryLog.dnsmasqLine(state, line, chains, time.Now())
+	}
+
+	want := map[string][]GroupID{"203.0.113.3/32": {0}}
+	if got := learnedRoutes(state); !reflect.DeepEqual(got, want) {
+		t.Errorf("learned %v, want %v", got, want)
+	}
+	if len(chains) > 0 {
+		t.Errorf("chains without serial numbers kept: %v", chains)
+	}
+}
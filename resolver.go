@@ -34,68 +34,165 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"sort"
+	"strings"
+	"time"
 
 	dns_impl "github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
 	_ "github.com/vishvananda/netlink"
 )
 
-func resolve(target string, nameserver net.IP) ([]net.IP, error) {
-	for {
-		reply, err := dnsQuery(target, nameserver)
+// DefaultUDPSize is EDNS0 buffer size advertised in UDP queries
+// (avoids IP fragmentation, as recommended by DNS flag day 2020)
+const DefaultUDPSize = 1232
+
+// DefaultResolverTimeout limits each query (dial, write and read)
+const DefaultResolverTimeout = 2 * time.Second
 
+// MaxCNAMEDepth limits length of CNAME chain (CNAME records followed)
+const MaxCNAMEDepth = 8
+
+// resolve the name to A records, following CNAME chain within the reply,
+// and with follow-up queries while the reply ends with CNAME only
+func (resolver *Resolver) resolve(ctx context.Context, target string, nameserver net.IP) (Resolution, error) {
+	result := newResolution(target)
+	for {
+		current := result.Name()
+		reply, err := resolver.dnsQuery(ctx, current, nameserver)
 		if err != nil {
-			return nil, fmt.Errorf("dnsQuery error for %s: %s", target, err.Error())
+			return result, fmt.Errorf("dnsQuery error for %s: %s", current, err.Error())
 		}
 
-		if ips := getAnswer(reply); ips != nil {
-			return ips, nil
-		} else if cnameTarget := getCNAME(reply); cnameTarget != "" {
-			return resolve(cnameTarget, nameserver)
-		} else {
-			return nil, fmt.Errorf("Unable to resolve %s to A or CNAME", target)
+		followed := len(result.Chain)
+		if err := result.follow(reply.Answer); err != nil {
+			return result, err
+		}
+		if len(result.IPs) > 0 {
+			return result, nil
+		}
+		if len(result.Chain) == followed {
+			return result, fmt.Errorf("Unable to resolve %s to A or CNAME", current)
 		}
+		log.Debug().Msgf("%s: reply has no A records for CNAME target, querying %s", target, result.Name())
 	}
 }
 
-func getAnswer(reply *dns_impl.Msg) []net.IP {
-	var ips []net.IP
+func newResolution(name string) Resolution {
+	return Resolution{Chain: []string{normalizeName(name)}, TTL: math.MaxUint32}
+}
+
+// Name at the end of CNAME chain
+func (result *Resolution) Name() string {
+	return result.Chain[len(result.Chain)-1]
+}
 
-	for _, record := range reply.Answer {
-		if record.Header().Rrtype == dns_impl.TypeA {
-			ips = append(ips, record.(*dns_impl.A).A)
+// follow CNAME chain through the answer records, collecting A records of
+// the last name. Chain longer than MaxCNAMEDepth or with loop is an error.
+func (result *Resolution) follow(answer []dns_impl.RR) error {
+	cnames := make(map[string]*dns_impl.CNAME)
+	addresses := make(map[string][]*dns_impl.A)
+	for _, record := range answer {
+		switch record := record.(type) {
+		case *dns_impl.CNAME:
+			name := normalizeName(record.Hdr.Name)
+			if _, exists := cnames[name]; !exists {
+				cnames[name] = record
+			}
+		case *dns_impl.A:
+			name := normalizeName(record.Hdr.Name)
+			addresses[name] = append(addresses[name], record)
 		}
 	}
 
-	if len(ips) > 0 {
-		return ips
-	}
+	for {
+		if records := addresses[result.Name()]; len(records) > 0 {
+			for _, record := range records {
+				result.IPs = append(result.IPs, record.A)
+				result.expire(record.Hdr.Ttl)
+			}
+			return nil
+		}
 
-	return nil
-}
+		cname, exists := cnames[result.Name()]
+		if !exists {
+			return nil
+		}
 
-func getCNAME(reply *dns_impl.Msg) string {
-	for _, record := range reply.Answer {
-		if record.Header().Rrtype == dns_impl.TypeCNAME {
-			return record.(*dns_impl.CNAME).Target
+		target := normalizeName(cname.Target)
+		for _, name := range result.Chain {
+			if name == target {
+				return fmt.Errorf("CNAME loop: %s -> %s", strings.Join(result.Chain, " -> "), target)
+			}
 		}
+		if len(result.Chain) > MaxCNAMEDepth {
+			return fmt.Errorf("CNAME chain is longer than %d: %s -> %s", MaxCNAMEDepth, strings.Join(result.Chain, " -> "), target)
+		}
+
+		result.Chain = append(result.Chain, target)
+		result.expire(cname.Hdr.Ttl)
 	}
+}
 
-	return ""
+// expire result no later than record TTL
+func (result *Resolution) expire(ttl uint32) {
+	if ttl < result.TTL {
+		result.TTL = ttl
+	}
 }
 
-func dnsQuery(name string, server net.IP) (*dns_impl.Msg, error) {
+// dnsQuery for A records, over resolver network. Truncated UDP replies
+// (answer exceeds EDNS0 buffer size) are retried over TCP.
+func (resolver *Resolver) dnsQuery(ctx context.Context, name string, server net.IP) (*dns_impl.Msg, error) {
 	msg := new(dns_impl.Msg)
 	msg.SetQuestion(name+".", dns_impl.TypeA)
-	c := new(dns_impl.Client)
-	reply, _, err := c.Exchange(msg, server.String()+":53")
+	address := net.JoinHostPort(server.String(), "53")
+
+	c := &dns_impl.Client{Net: resolver.Network, Timeout: resolver.timeout}
+	if resolver.Network == "udp" {
+		msg.SetEdns0(resolver.UDPSize, false)
+	}
+
+	reply, err := exchange(ctx, c, msg, address)
+	if err == nil && reply.Truncated && resolver.Network == "udp" {
+		log.Debug().Msgf("%s: truncated reply from %s (%d bytes buffer), retrying over TCP", name, server, resolver.UDPSize)
+		c.Net = "tcp"
+		return exchange(ctx, c, msg, address)
+	}
 
 	return reply, err
 }
 
+// exchange message with the server, interrupted when context is cancelled
+func exchange(ctx context.Context, c *dns_impl.Client, msg *dns_impl.Msg, address string) (*dns_impl.Msg, error) {
+	conn, err := c.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	reply, _, err := c.ExchangeWithConn(msg, conn)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return reply, err
+}
+
 func (resolver *Resolver) init() error {
 	if len(resolver.ActionOnFail) == 0 {
 		resolver.ActionOnFail = FailActionDROP
@@ -109,6 +206,51 @@ func (resolver *Resolver) init() error {
 		return errors.New("No nameservers specified")
 	}
 
+	switch resolver.Strategy {
+	case "":
+		resolver.Strategy = StrategyFirst
+	case StrategyFirst, StrategyUnion, StrategyRace:
+	default:
+		msg := fmt.Sprintf("unsupported strategy \"%s\" (use %s, %s or %s)", resolver.Strategy, StrategyFirst, StrategyUnion, StrategyRace)
+		return errors.New(msg)
+	}
+
+	switch resolver.Network {
+	case "":
+		resolver.Network = "udp"
+	case "udp", "tcp":
+	default:
+		msg := fmt.Sprintf("unsupported network \"%s\" (use udp or tcp)", resolver.Network)
+		return errors.New(msg)
+	}
+
+	if resolver.UDPSize == 0 {
+		resolver.UDPSize = DefaultUDPSize
+	} else if resolver.UDPSize < dns_impl.MinMsgSize {
+		return fmt.Errorf("udp_size %d is less than %d", resolver.UDPSize, dns_impl.MinMsgSize)
+	}
+
+	resolver.timeout = DefaultResolverTimeout
+	if len(resolver.Timeout) > 0 {
+		timeout, err := time.ParseDuration(resolver.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("timeout \"%s\" is not valid duration", resolver.Timeout)
+		}
+		resolver.timeout = timeout
+	}
+
+	if resolver.Retry != nil {
+		if err := resolver.Retry.init(); err != nil {
+			return fmt.Errorf("retry: %v", err)
+		}
+	}
+
+	var err error
+	resolver.ns, err = openNetns(resolver.Netns)
+	if err != nil {
+		return err
+	}
+
 	resolver.NameServersIP = make([]net.IP, len(resolver.NameServers))
 	for i, dns := range resolver.NameServers {
 		ip := net.ParseIP(dns)
@@ -123,21 +265,217 @@ func (resolver *Resolver) init() error {
 	return nil
 }
 
-// Resolve to get all domain name A records
-func (resolver *Resolver) Resolve(domain string) ([]net.IP, error) {
+// Resolve to get all domain name A records, with CNAME chain, using
+// nameservers according to resolver strategy
+func (resolver *Resolver) Resolve(ctx context.Context, domain string) (Resolution, error) {
+	switch resolver.Strategy {
+	case StrategyUnion:
+		return resolver.resolveUnion(ctx, domain)
+	case StrategyRace:
+		return resolver.resolveRace(ctx, domain)
+	}
+	return resolver.resolveFirst(ctx, domain)
+}
+
+// resolveFirst asks nameservers in order, until one answers
+func (resolver *Resolver) resolveFirst(ctx context.Context, domain string) (Resolution, error) {
 	var (
-		result []net.IP
+		result Resolution
 		err    error
 	)
 
-	for i, dns := range resolver.NameServersIP {
-		result, err = resolve(domain, dns)
-		if err == nil {
+	for i := range resolver.NameServersIP {
+		result, err = resolver.resolveWith(ctx, domain, i)
+		if err == nil || ctx.Err() != nil {
 			break
 		}
-		log.Warn().Msgf("Resolution failed using DNS %s domain %s type A: %v (%d/%d)",
-			resolver.NameServers[i], domain, err, i+1, len(resolver.NameServersIP))
 	}
 
 	return result, err
 }
+
+// resolveUnion asks all nameservers in parallel, merging their answers:
+// addresses and CNAME chain names of all, minimum TTL
+func (resolver *Resolver) resolveUnion(ctx context.Context, domain string) (Resolution, error) {
+	answers := make([]resolverAnswer, len(resolver.NameServersIP))
+	delivered := resolver.resolveAll(ctx, domain)
+	for range answers {
+		answer := <-delivered
+		answers[answer.index] = answer
+	}
+
+	var (
+		union Resolution
+		found bool
+		err   error
+	)
+	for i, answer := range answers {
+		if answer.err != nil {
+			err = answer.err
+			continue
+		}
+
+		if !found {
+			union, found = answer.result, true
+			union.IPs = append([]net.IP(nil), union.IPs...)
+			union.Chain = append([]string(nil), union.Chain...)
+			union.Provenance = make(map[string][]net.IP)
+		} else {
+			union.IPs = appendNewIPs(union.IPs, answer.result.IPs)
+			union.Chain = appendNewNames(union.Chain, answer.result.Chain)
+			union.expire(answer.result.TTL)
+		}
+		union.Provenance[resolver.NameServers[i]] = answer.result.IPs
+	}
+
+	if !found {
+		return union, err
+	}
+	log.Debug().Msgf("%s: union of %d answers: %s", domain, len(union.Provenance), union.provenance())
+	return union, nil
+}
+
+// resolveRace asks all nameservers in parallel, the first answer wins
+// (other queries are cancelled)
+func (resolver *Resolver) resolveRace(ctx context.Context, domain string) (Resolution, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	answers := resolver.resolveAll(raceCtx, domain)
+
+	var err error
+	for range resolver.NameServersIP {
+		answer := <-answers
+		if answer.err == nil {
+			log.Debug().Msgf("%s: race won by %s", domain, resolver.NameServers[answer.index])
+			return answer.result, nil
+		}
+		err = answer.err
+	}
+
+	return Resolution{}, err
+}
+
+// resolverAnswer of the nameserver (by index)
+type resolverAnswer struct {
+	index  int
+	result Resolution
+	err    error
+}
+
+// resolveAll starts parallel queries to all nameservers, answers are
+// delivered in order of arrival
+func (resolver *Resolver) resolveAll(ctx context.Context, domain string) <-chan resolverAnswer {
+	answers := make(chan resolverAnswer, len(resolver.NameServersIP))
+	for i := range resolver.NameServersIP {
+		go func(i int) {
+			result, err := resolver.resolveWith(ctx, domain, i)
+			answers <- resolverAnswer{index: i, result: result, err: err}
+		}(i)
+	}
+	return answers
+}
+
+// resolveWith the nameserver (by index), recording provenance of the answer
+func (resolver *Resolver) resolveWith(ctx context.Context, domain string, i int) (Resolution, error) {
+	var result Resolution
+
+	err := inNetns(resolver.ns, func() error {
+		var err error
+		result, err = resolver.resolve(ctx, domain, resolver.NameServersIP[i])
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warn().Msgf("Resolution failed using DNS %s domain %s type A: %v (%d/%d)",
+				resolver.NameServers[i], domain, err, i+1, len(resolver.NameServersIP))
+		}
+		return result, err
+	}
+
+	result.Provenance = map[string][]net.IP{resolver.NameServers[i]: result.IPs}
+	return result, nil
+}
+
+// provenance of the addresses: nameservers which answered with each one
+func (result *Resolution) provenance() string {
+	nameservers := make([]string, 0, len(result.Provenance))
+	for nameserver := range result.Provenance {
+		nameservers = append(nameservers, nameserver)
+	}
+	sort.Strings(nameservers)
+
+	parts := make([]string, 0, len(result.IPs))
+	for _, ip := range result.IPs {
+		var from []string
+		for _, nameserver := range nameservers {
+			for _, answered := range result.Provenance[nameserver] {
+				if answered.Equal(ip) {
+					from = append(from, nameserver)
+					break
+				}
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", ip, strings.Join(from, ", ")))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// appendNewIPs appends addresses not in the list yet
+func appendNewIPs(ips []net.IP, more []net.IP) []net.IP {
+	for _, ip := range more {
+		exists := false
+		for _, known := range ips {
+			if known.Equal(ip) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// appendNewNames appends names not in the list yet
+func appendNewNames(names []string, more []string) []string {
+	for _, name := range more {
+		exists := false
+		for _, known := range names {
+			if known == name {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Exchange forwards DNS message as-is to resolver nameservers (in order),
+// returning the first reply. Network is the one of the client (truncated
+// replies are passed to client to retry over TCP).
+func (resolver *Resolver) Exchange(ctx context.Context, msg *dns_impl.Msg, network string) (*dns_impl.Msg, error) {
+	var (
+		reply *dns_impl.Msg
+		err   error
+	)
+
+	c := &dns_impl.Client{Net: network, Timeout: resolver.timeout}
+	for i, dns := range resolver.NameServersIP {
+		err = inNetns(resolver.ns, func() error {
+			reply, err = exchange(ctx, c, msg, net.JoinHostPort(dns.String(), "53"))
+			return err
+		})
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		log.Warn().Msgf("Forwarding failed using DNS %s: %v (%d/%d)",
+			resolver.NameServers[i], err, i+1, len(resolver.NameServersIP))
+	}
+
+	return reply, err
+}
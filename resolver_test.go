@@ -0,0 +1,277 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	dns_impl "github.com/miekg/dns"
+)
+
+func parseRecords(t *testing.T, records ...string) []dns_impl.RR {
+	answer := make([]dns_impl.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := dns_impl.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer = append(answer, rr)
+	}
+	return answer
+}
+
+// cnameChain of [length] CNAME records from "c0.example.com", ending with A
+func cnameChain(length int) []string {
+	records := make([]string, 0, length+1)
+	for i := 0; i < length; i++ {
+		records = append(records, fmt.Sprintf("c%d.example.com. 60 IN CNAME c%d.example.com.", i, i+1))
+	}
+	return append(records, fmt.Sprintf("c%d.example.com. 60 IN A 203.0.113.1", length))
+}
+
+func TestResolutionFollow(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  []string
+		chain   []string
+		ips     []string
+		ttl     uint32
+		invalid bool
+	}{
+		{
+			name:   "example.com",
+			answer: []string{"example.com. 300 IN A 203.0.113.1", "example.com. 60 IN A 203.0.113.2"},
+			chain:  []string{"example.com"},
+			ips:    []string{"203.0.113.1", "203.0.113.2"},
+			ttl:    60,
+		},
+		{
+			name: "WWW.Example.com.",
+			answer: []string{
+				"edge.cdn.net. 20 IN A 203.0.113.5", // records out of order
+				"other.org. 1 IN A 198.51.100.1",
+				"www.example.com. 300 IN CNAME Edge.CDN.net.",
+			},
+			chain: []string{"www.example.com", "edge.cdn.net"},
+			ips:   []string{"203.0.113.5"},
+			ttl:   20,
+		},
+		{
+			name:   "www.example.com",
+			answer: []string{"www.example.com. 30 IN CNAME edge.cdn.net."}, // target not in reply
+			chain:  []string{"www.example.com", "edge.cdn.net"},
+			ttl:    30,
+		},
+		{
+			name:   "other.org",
+			answer: []string{"example.com. 60 IN A 203.0.113.1"},
+			chain:  []string{"other.org"},
+			ttl:    1<<32 - 1,
+		},
+		{
+			name:    "a.example.com",
+			answer:  []string{"a.example.com. 60 IN CNAME b.example.com.", "b.example.com. 60 IN CNAME a.example.com."},
+			invalid: true,
+		},
+		{
+			name:   "c0.example.com",
+			answer: cnameChain(MaxCNAMEDepth),
+			chain: []string{"c0.example.com", "c1.example.com", "c2.example.com", "c3.example.com", "c4.example.com",
+				"c5.example.com", "c6.example.com", "c7.example.com", "c8.example.com"},
+			ips: []string{"203.0.113.1"},
+			ttl: 60,
+		},
+		{
+			name:    "c0.example.com",
+			answer:  cnameChain(MaxCNAMEDepth + 1),
+			invalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		result := newResolution(test.name)
+		err := result.follow(parseRecords(t, test.answer...))
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s %v: no error, chain %v", test.name, test.answer, result.Chain)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %v: %v", test.name, test.answer, err)
+			continue
+		}
+
+		var ips []string
+		for _, ip := range result.IPs {
+			ips = append(ips, ip.String())
+		}
+		if !reflect.DeepEqual(result.Chain, test.chain) || !reflect.DeepEqual(ips, test.ips) || result.TTL != test.ttl {
+			t.Errorf("%s %v: chain %v, IPs %v, TTL %d; want %v, %v, %d",
+				test.name, test.answer, result.Chain, ips, result.TTL, test.chain, test.ips, test.ttl)
+		}
+	}
+}
+
+func TestResolutionFollowUp(t *testing.T) {
+	result := newResolution("www.example.com")
+	if err := result.follow(parseRecords(t, "www.example.com. 300 IN CNAME edge.cdn.net.")); err != nil {
+		t.Fatal(err)
+	}
+	// follow-up query for the CNAME target
+	if err := result.follow(parseRecords(t, "edge.cdn.net. 60 IN A 203.0.113.5")); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Name() != "edge.cdn.net" || len(result.IPs) != 1 || !result.IPs[0].Equal(net.IPv4(203, 0, 113, 5)) || result.TTL != 60 {
+		t.Errorf("chain %v, IPs %v, TTL %d", result.Chain, result.IPs, result.TTL)
+	}
+}
+
+// nameserverStandIn serves DNS on port 53 of the loopback address (test
+// is skipped without privileges): A records of the answer, SERVFAIL when
+// there are none. Answer is delayed (if positive), but not past test end.
+func nameserverStandIn(t *testing.T, address string, delay time.Duration, answer ...string) {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(address, "53"))
+	if err != nil {
+		t.Skipf("nameserver stand-in: %v", err)
+	}
+
+	finished := make(chan struct{})
+	server := &dns_impl.Server{PacketConn: conn, Handler: dns_impl.HandlerFunc(func(w dns_impl.ResponseWriter, r *dns_impl.Msg) {
+		select {
+		case <-time.After(delay):
+		case <-finished:
+		}
+		reply := new(dns_impl.Msg)
+		reply.SetReply(r)
+		for _, record := range answer {
+			rr, _ := dns_impl.NewRR(r.Question[0].Name + " " + record)
+			reply.Answer = append(reply.Answer, rr)
+		}
+		if len(answer) == 0 {
+			reply.Rcode = dns_impl.RcodeServerFailure
+		}
+		w.WriteMsg(reply)
+	})}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		close(finished)
+		server.Shutdown()
+	})
+}
+
+func newTestResolver(t *testing.T, strategy Strategy, nameservers ...string) *Resolver {
+	resolver := &Resolver{NameServers: nameservers, Strategy: strategy, Timeout: "2s"}
+	if err := resolver.init(); err != nil {
+		t.Fatal(err)
+	}
+	return resolver
+}
+
+func TestResolveUnion(t *testing.T) {
+	nameserverStandIn(t, "127.0.0.21", 0, "300 IN A 203.0.113.1", "300 IN A 203.0.113.2")
+	nameserverStandIn(t, "127.0.0.22", 0, "60 IN A 203.0.113.2", "60 IN A 203.0.113.3")
+	nameserverStandIn(t, "127.0.0.23", 0) // fails
+
+	resolver := newTestResolver(t, StrategyUnion, "127.0.0.21", "127.0.0.22", "127.0.0.23")
+	result, err := resolver.Resolve(context.Background(), "pool.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ips []string
+	for _, ip := range result.IPs {
+		ips = append(ips, ip.String())
+	}
+	if want := []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("IPs %v, want %v", ips, want)
+	}
+	if result.TTL != 60 {
+		t.Errorf("TTL %d, want minimum 60", result.TTL)
+	}
+	if len(result.Provenance) != 2 || len(result.Provenance["127.0.0.21"]) != 2 || len(result.Provenance["127.0.0.22"]) != 2 {
+		t.Errorf("provenance %v", result.Provenance)
+	}
+
+	failing := newTestResolver(t, StrategyUnion, "127.0.0.23", "127.0.0.23")
+	if _, err := failing.Resolve(context.Background(), "pool.example.com"); err == nil {
+		t.Error("no error when all nameservers fail")
+	}
+}
+
+func TestResolveRace(t *testing.T) {
+	nameserverStandIn(t, "127.0.0.21", 0)                                          // fails first
+	nameserverStandIn(t, "127.0.0.22", 50*time.Millisecond, "60 IN A 203.0.113.2") // wins
+	nameserverStandIn(t, "127.0.0.23", time.Minute, "60 IN A 203.0.113.3")         // never answers in time
+
+	resolver := newTestResolver(t, StrategyRace, "127.0.0.21", "127.0.0.22", "127.0.0.23")
+	started := time.Now()
+	result, err := resolver.Resolve(context.Background(), "pool.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.IPs) != 1 || !result.IPs[0].Equal(net.IPv4(203, 0, 113, 2)) {
+		t.Errorf("IPs %v, want answer of the fastest nameserver", result.IPs)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("race took %v, waiting for slower nameserver", elapsed)
+	}
+
+	failing := newTestResolver(t, StrategyRace, "127.0.0.21", "127.0.0.21")
+	if _, err := failing.Resolve(context.Background(), "pool.example.com"); err == nil {
+		t.Error("no error when all nameservers fail")
+	}
+
+	// cancelled resolution does not wait for the query timeout
+	slow := newTestResolver(t, StrategyRace, "127.0.0.23")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started = time.Now()
+	if _, err := slow.Resolve(ctx, "pool.example.com"); err == nil {
+		t.Error("no error when resolution is cancelled")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("cancelled race took %v", elapsed)
+	}
+}
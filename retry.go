@@ -0,0 +1,136 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Retry policy defaults
+const (
+	DefaultRetryBackoff    = 5 * time.Second
+	DefaultRetryMaxBackoff = 5 * time.Minute
+)
+
+func (policy *RetryPolicy) init() error {
+	if policy.Attempts < 0 {
+		return errors.New("attempts may not be negative")
+	}
+
+	durations := []struct {
+		name     string
+		value    string
+		fallback time.Duration
+		parsed   *time.Duration
+	}{
+		{"backoff", policy.Backoff, DefaultRetryBackoff, &policy.backoff},
+		{"max_backoff", policy.MaxBackoff, DefaultRetryMaxBackoff, &policy.maxBackoff},
+		{"jitter", policy.Jitter, 0, &policy.jitter},
+	}
+	for _, duration := range durations {
+		*duration.parsed = duration.fallback
+		if len(duration.value) == 0 {
+			continue
+		}
+		parsed, err := time.ParseDuration(duration.value)
+		if err != nil || parsed < 0 {
+			msg := fmt.Sprintf("%s: error reading duration string \"%s\": %v", duration.name, duration.value, err)
+			return errors.New(msg)
+		}
+		*duration.parsed = parsed
+	}
+
+	if policy.backoff == 0 {
+		return errors.New("backoff must be positive")
+	}
+	if policy.maxBackoff < policy.backoff {
+		policy.maxBackoff = policy.backoff
+	}
+	return nil
+}
+
+// delay before retry after consecutive failures (starting from 1),
+// false when fast retries are exhausted
+func (policy *RetryPolicy) delay(failures int) (time.Duration, bool) {
+	if failures < 1 || (policy.Attempts > 0 && failures > policy.Attempts) {
+		return 0, false
+	}
+
+	delay := policy.backoff
+	for i := 1; i < failures && delay < policy.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > policy.maxBackoff {
+		delay = policy.maxBackoff
+	}
+	return delay, true
+}
+
+// retry failing domain of the task sooner than group interval (if policy
+// allows), logging backoff state
+func (task Task) retry(scheduler *Scheduler) {
+	group := task.Group
+	failures := group.failures[task.Domain]
+	policy := group.resolver.Retry
+	if failures == 0 || policy == nil {
+		return
+	}
+
+	delay, ok := policy.delay(failures)
+	if !ok {
+		log.Warn().Msgf("sources.%d: %s failed %d times in a row, retrying every %v",
+			group.index, task.Domain, failures, group.interval)
+		return
+	}
+	if delay >= group.interval {
+		log.Warn().Msgf("sources.%d: %s failed %d times in a row, backoff %v reached interval, retrying every %v",
+			group.index, task.Domain, failures, delay, group.interval)
+		return
+	}
+
+	log.Warn().Msgf("sources.%d: %s failed %d times in a row, retry %s in %v",
+		group.index, task.Domain, failures, retryAttempt(failures, policy.Attempts), delay)
+	scheduler.RunAfter(task, delay, policy.jitter)
+}
+
+func retryAttempt(failures, attempts int) string {
+	if attempts == 0 {
+		return fmt.Sprintf("%d", failures)
+	}
+	return fmt.Sprintf("%d/%d", failures, attempts)
+}
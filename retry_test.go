@@ -0,0 +1,126 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{Attempts: 5, Backoff: "1s", MaxBackoff: "5s"}
+	if err := policy.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		delay time.Duration
+		ok    bool
+	}{
+		{0, false}, // no failures
+		{time.Second, true},
+		{2 * time.Second, true},
+		{4 * time.Second, true},
+		{5 * time.Second, true}, // capped
+		{5 * time.Second, true},
+		{0, false}, // attempts exhausted
+	}
+	for failures, w := range want {
+		delay, ok := policy.delay(failures)
+		if delay != w.delay || ok != w.ok {
+			t.Errorf("delay(%d) = %v, %v; want %v, %v", failures, delay, ok, w.delay, w.ok)
+		}
+	}
+
+	unlimited := &RetryPolicy{}
+	if err := unlimited.init(); err != nil {
+		t.Fatal(err)
+	}
+	if delay, ok := unlimited.delay(1000); !ok || delay != DefaultRetryMaxBackoff {
+		t.Errorf("unlimited attempts: delay(1000) = %v, %v", delay, ok)
+	}
+}
+
+func TestRetryPolicyInit(t *testing.T) {
+	for _, policy := range []RetryPolicy{
+		{Attempts: -1},
+		{Backoff: "0s"},
+		{Backoff: "-1s"},
+		{MaxBackoff: "soon"},
+		{Jitter: "-5s"},
+	} {
+		policy := policy
+		if err := policy.init(); err == nil {
+			t.Errorf("%+v: no error", policy)
+		}
+	}
+
+	policy := &RetryPolicy{Backoff: "1m", MaxBackoff: "10s"}
+	if err := policy.init(); err != nil || policy.maxBackoff != time.Minute {
+		t.Errorf("max_backoff below backoff: %v, max backoff %v", err, policy.maxBackoff)
+	}
+}
+
+func TestSampleKeepsFailures(t *testing.T) {
+	nameserverStandIn(t, "127.0.0.21", 0) // fails
+	nameserverStandIn(t, "127.0.0.22", 0, "60 IN A 203.0.113.1")
+	failing := newTestResolver(t, StrategyFirst, "127.0.0.21")
+	answering := newTestResolver(t, StrategyFirst, "127.0.0.22")
+
+	state := newTestState(t)
+	group := &Group{
+		samples:   3,
+		resolved:  make(map[string][]net.IP),
+		failures:  make(map[string]int),
+		sightings: make(map[string]map[string]sighting),
+		rounds:    make(map[string]*samplingRound),
+	}
+
+	// updates fail, some of their samples succeed
+	for update := 1; update <= 2; update++ {
+		group.resolver = failing
+		group.resolve(state, "pool.example.com", 0)
+		group.resolver = answering
+		group.resolve(state, "pool.example.com", 1)
+		if failures := group.failures["pool.example.com"]; failures != update {
+			t.Errorf("update %d: %d failures, want %d", update, failures, update)
+		}
+	}
+
+	group.resolve(state, "pool.example.com", 0)
+	if failures := group.failures["pool.example.com"]; failures != 0 {
+		t.Errorf("%d failures after successful update", failures)
+	}
+}
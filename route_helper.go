@@ -34,117 +34,514 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"sort"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-func (helper *RouteHelper) mkRoute(ip *net.IPNet, gw net.IP, link netlink.Link) netlink.Route {
-	return netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst:       ip,
-		Gw:        gw,
-		Priority:  helper.metric,
-		Flags:     int(netlink.FLAG_ONLINK),
+// Reset helper for use with new targets (links and gateways).
+// All routes are flushed and group assignments are cleared.
+func (helper *RouteHelper) Reset(targets map[string]*RouteTarget) {
+	helper.Flush()
+
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	helper.targets = targets
+	helper.groups = make(map[GroupID]groupRoute)
+	helper.killSwitches = make(map[string]*RouteTarget)
+	helper.routes = make(routesMap)
+}
+
+// Assign group (owner) to the target. When groups on different targets
+// want the same destination, route goes via target of the group with
+// highest priority (lower group index on equal priority).
+// Kill switch replaces group routes while no target is usable.
+// Routes of group with no target (empty name) are only exported.
+func (helper *RouteHelper) Assign(owner GroupID, targetName string, priority int, killSwitch KillSwitch) {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	group := groupRoute{priority: priority}
+	if len(targetName) == 0 {
+		helper.groups[owner] = group
+		return
+	}
+
+	target, exists := helper.targets[targetName]
+	if !exists {
+		log.Fatal().Msgf("sources.%d: unknown target \"%s\"", owner, targetName)
+	}
+
+	group.target = target
+	if killSwitch != KillSwitchOff {
+		key := fmt.Sprintf("%s/%d/%s", killSwitch, target.metric, target.nsName)
+		if _, exists := helper.killSwitches[key]; !exists {
+			helper.killSwitches[key] = newKillSwitch(killSwitch, target)
+		}
+		group.killSwitch = helper.killSwitches[key]
+	}
+
+	helper.groups[owner] = group
+}
+
+// AddExporter to receive the route table on changes (in addition to netlink routes)
+func (helper *RouteHelper) AddExporter(exporter RouteExporter) {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	helper.exporters = append(helper.exporters, exporter)
+}
+
+// StartExports of the route table, once it is filled by group updates
+// (exporters would see incomplete table otherwise)
+func (helper *RouteHelper) StartExports() {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	helper.exporting = true
+	helper.changed = true
+}
+
+// unlock helper, committing pending changes of targets (WireGuard peers)
+// and exporting the route table, if changed
+func (helper *RouteHelper) unlock() {
+	for _, target := range helper.targets {
+		if peer := target.wireguard; peer != nil && peer.dirty {
+			err := inNetns(target.netns, func() error {
+				peer.commit()
+				return nil
+			})
+			if err != nil {
+				log.Error().Msgf("targets.%s: %v", target.name, err)
+			}
+		}
+	}
+	if helper.changed && helper.exporting {
+		routes := helper.snapshot()
+		for _, exporter := range helper.exporters {
+			exporter.Export(routes)
+		}
 	}
+	helper.changed = false
+	helper.mu.Unlock()
 }
 
-func (helper *RouteHelper) addRoute(ip *net.IPNet, gw net.IP, link netlink.Link) {
-	log.Info().Msgf("ROUTE ADD: %s via %s dev %s onlink", ip, gw, helper.linkName())
-	route := helper.mkRoute(ip, gw, link)
-	if err := netlink.RouteAdd(&route); err != nil {
-		log.Error().Msgf("route_add fail (%s, %s, %s): %v", ip.String(), gw.String(), helper.linkName(), err)
+// snapshot of the route table for exporters, ordered by destination
+func (helper *RouteHelper) snapshot() []ExportedRoute {
+	routes := make([]ExportedRoute, 0, len(helper.routes))
+	for _, ipData := range helper.routes {
+		owners := make([]GroupID, 0, len(ipData.owners)+len(ipData.learned))
+		for owner := range ipData.owners {
+			owners = append(owners, owner)
+		}
+		for owner := range ipData.learned {
+			if _, exists := ipData.owners[owner]; !exists {
+				owners = append(owners, owner)
+			}
+		}
+		sort.Slice(owners, func(i, j int) bool { return owners[i] < owners[j] })
+
+		winner, _ := helper.winner(ipData)
+		routes = append(routes, ExportedRoute{Dst: ipData.dst, Owners: owners, Winner: winner})
 	}
+
+	sort.Slice(routes, func(i, j int) bool { return lessNetwork(routes[i].Dst, routes[j].Dst) })
+
+	return routes
 }
 
-func (helper *RouteHelper) rmRoute(ip *net.IPNet, gw net.IP, link netlink.Link) {
-	log.Info().Msgf("ROUTE DEL: %s via %s dev %s onlink", ip, gw, helper.linkName())
-	route := helper.mkRoute(ip, gw, link)
-	if err := netlink.RouteDel(&route); err != nil {
-		log.Error().Msgf("route_del fail (%s, %s): %v", ip.String(), gw.String(), err)
+// lessNetwork orders destinations by address, then by prefix length
+func lessNetwork(a, b *net.IPNet) bool {
+	if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+		return c < 0
 	}
+	return bytes.Compare(a.Mask, b.Mask) < 0
 }
 
-// Reset helper for use with new link and target gateway IP
-func (helper *RouteHelper) Reset(linkName, gw string, metric int) {
-	helper.Flush()
+func (helper *RouteHelper) checkInit(owner GroupID) {
+	if helper.routes == nil {
+		panic("RouteHelper was not initialized with targets to use.")
+	}
+	if _, assigned := helper.groups[owner]; !assigned {
+		panic("RouteHelper group was not assigned to a target.")
+	}
+}
+
+// Add route (phusically, if new) with ownership and
+// option to avoid duplication (othwerise, increase refcount of the route)
+func (helper *RouteHelper) Add(owner GroupID, dst *net.IPNet, increaseRef bool) {
+	helper.mu.Lock()
+	defer helper.unlock()
 
-	var err error
+	if helper.closed {
+		return
+	}
+
+	helper.add(owner, dst, increaseRef)
+}
+
+func (helper *RouteHelper) add(owner GroupID, dst *net.IPNet, increaseRef bool) {
+	helper.checkInit(owner)
 
-	helper.link, err = netlink.LinkByName(linkName)
-	if err != nil {
-		msg := fmt.Sprintf("RouteHelper.Reset() fail for link/iface \"%s\": %v", linkName, err)
-		if err == netlink.ErrNotImplemented {
-			msg += ". Netlink library reported no-support for effective environment or operating system."
+	ipData := helper.lookup(dst)
+	if refCount, ownerExists := ipData.owners[owner]; ownerExists {
+		if increaseRef {
+			ipData.owners[owner] = refCount + 1
 		}
-		log.Fatal().Msg(msg)
+	} else {
+		ipData.owners[owner] = 1
+		helper.changed = true
+		helper.sync(ipData)
 	}
+}
+
+// lookup existing route data, or create one with no owners (not installed)
+func (helper *RouteHelper) lookup(dst *net.IPNet) *routeData {
+	key := ipstr(dst.String())
 
-	helper.gw = net.ParseIP(gw)
-	if helper.gw == nil {
-		log.Fatal().Msgf("Failed to parse gateway address \"%s\"", gw)
+	ipData, exists := helper.routes[key]
+	if !exists {
+		ipData = &routeData{
+			dst:     dst,
+			owners:  make(map[GroupID]int),
+			learned: make(map[GroupID]time.Time),
+		}
+		helper.routes[key] = ipData
 	}
 
-	helper.metric = metric
+	return ipData
+}
 
-	helper.routes = make(routesMap)
+// available tells target to use for the group: assigned target or first
+// of its fallback targets which is healthy (nil if there is none)
+func (helper *RouteHelper) available(owner GroupID) *RouteTarget {
+	target := helper.groups[owner].target
+	if target == nil {
+		return nil
+	}
+	if target.usable() {
+		return target
+	}
+	for _, fallback := range target.fallback {
+		if fallback.usable() {
+			return fallback
+		}
+	}
+	return nil
 }
 
-// Tell link (interface) name from internal pointer
-func (helper *RouteHelper) linkName() string {
-	if helper.link != nil {
-		if as := helper.link.Attrs(); as != nil {
-			if len(as.Name) > 0 {
-				return as.Name
+// winner tells the owner whose target is used for the route: owners with
+// an available target first, then highest priority, then lowest index
+func (helper *RouteHelper) winner(ipData *routeData) (GroupID, bool) {
+	var (
+		best          GroupID
+		bestAvailable bool
+		found         bool
+	)
+
+	consider := func(owner GroupID) {
+		available := helper.available(owner) != nil
+		if found {
+			p, bp := helper.groups[owner].priority, helper.groups[best].priority
+			if available != bestAvailable {
+				if !available {
+					return
+				}
+			} else if p < bp || (p == bp && owner > best) {
+				return
 			}
 		}
+		best, bestAvailable, found = owner, available, true
 	}
 
-	return "link-noname"
+	for owner := range ipData.owners {
+		consider(owner)
+	}
+	for owner := range ipData.learned {
+		consider(owner)
+	}
+
+	return best, found
 }
 
-// Add route (phusically, if new) with ownership and
-// option to avoid duplication (othwerise, increase refcount of the route)
-func (helper *RouteHelper) Add(owner GroupID, ip net.IP, increaseRef bool) {
-	if helper.link == nil || helper.routes == nil {
-		panic("RouteHelper was not initialized with an interface/gateway to use.")
+// sync physical route with ownership: route is installed via target of the
+// winning owner (moved, if winner target changed), or deleted when orphaned.
+// When there is no usable target for it, winner kill switch route is used.
+// Adopted route is kept until ReleaseAdopted, and tagged once wanted.
+func (helper *RouteHelper) sync(ipData *routeData) {
+	var target *RouteTarget
+
+	owner, found := helper.winner(ipData)
+	if found {
+		target = helper.available(owner)
+		if target == nil {
+			target = helper.groups[owner].killSwitch
+		}
+	} else if ipData.adopted {
+		return
 	}
 
-	key := ipstr(ip.String())
+	if found && owner != ipData.winner {
+		ipData.winner = owner // exported attributes (BGP next hop) follow the winner
+		helper.changed = true
+	}
 
-	if ipData, exists := helper.routes[key]; exists {
-		owners := ipData.owners
-		if refCount, ownerExists := owners[owner]; ownerExists {
-			if increaseRef {
-				owners[owner] = refCount + 1
-			}
-		} else {
-			owners[owner] = 1
+	if ipData.target != target {
+		helper.changed = true
+		if ipData.target != nil {
+			helper.rmRoute(ipData)
+		}
+		if target != nil {
+			target.addRoute(ipData.dst)
 		}
+		ipData.target = target
+	} else if ipData.untagged {
+		target.replaceRoute(ipData.dst)
+		ipData.untagged = false
+	}
+
+	if ipData.orphaned() {
+		delete(helper.routes, ipstr(ipData.dst.String()))
+	}
+}
+
+// rmRoute of the destination from its target. Untagged adopted route
+// (matched on link, gateway and metric) is deleted regardless of protocol.
+func (helper *RouteHelper) rmRoute(ipData *routeData) {
+	if !ipData.untagged {
+		ipData.target.rmRoute(ipData.dst)
+		return
+	}
+
+	target := ipData.target
+	log.Info().Msgf("ROUTE DEL: %s (untagged)", target.describe(ipData.dst))
+	if target.wireguard != nil {
+		target.wireguard.remove(ipData.dst)
+	}
+	route := target.mkRoute(ipData.dst)
+	route.Protocol = 0
+	if err := target.handle.RouteDel(&route); err != nil && err != unix.ESRCH {
+		log.Error().Msgf("route_del fail (%s): %v", target.describe(ipData.dst), err)
+	}
+	ipData.untagged = false
+}
+
+// SetHealth of the target, moving routes of affected groups
+// to fallback targets (or back)
+func (helper *RouteHelper) SetHealth(target *RouteTarget, healthy bool) {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	helper.transition(func() {
+		target.healthy = healthy
+	})
+}
+
+// SetLink state of the target, moving routes of affected groups
+// to fallback targets (or back). Link may be re-created with new index.
+func (helper *RouteHelper) SetLink(target *RouteTarget, link netlink.Link, up bool) {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	if up == target.linkUp && link.Attrs().Index == target.link.Attrs().Index {
+		return
+	}
+
+	if up {
+		log.Warn().Msgf("TARGET %s: link %s is UP", target.name, link.Attrs().Name)
 	} else {
-		dst := &net.IPNet{
-			IP:   ip,
-			Mask: net.CIDRMask(32, 32),
+		log.Warn().Msgf("TARGET %s: link %s is DOWN", target.name, link.Attrs().Name)
+	}
+
+	if target.linkUp && link.Attrs().Index != target.link.Attrs().Index {
+		// re-created link: routes of old link are gone
+		helper.transition(func() {
+			target.linkUp = false
+		})
+	}
+
+	helper.transition(func() {
+		if up {
+			target.link = link
+		}
+		target.linkUp = up
+	})
+}
+
+// SetNexthop link state of multipath target. Nexthop is removed from
+// (or added back to) all routes of the target, routes move to fallback
+// targets (or back) only when there are no nexthops left.
+func (helper *RouteHelper) SetNexthop(target *RouteTarget, hop *nexthop, link netlink.Link, up bool) {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	if up == hop.up && link.Attrs().Index == hop.link.Attrs().Index {
+		return
+	}
+
+	if up {
+		log.Warn().Msgf("TARGET %s: nexthop link %s is UP", target.name, link.Attrs().Name)
+	} else {
+		log.Warn().Msgf("TARGET %s: nexthop link %s is DOWN", target.name, link.Attrs().Name)
+	}
+
+	change := func() {
+		if up {
+			hop.link = link
+		}
+		hop.up = up
+		target.linkUp = target.nexthopsUp()
+	}
+
+	linkUp := up
+	for _, other := range target.nexthops {
+		linkUp = linkUp || (other != hop && other.up)
+	}
+
+	if linkUp == target.linkUp {
+		// target stays usable (or unusable): rewrite routes in place
+		change()
+		for _, ipData := range helper.routes {
+			if ipData.target == target {
+				target.replaceRoute(ipData.dst)
+			}
+		}
+		return
+	}
+
+	helper.transition(change)
+}
+
+// SetGateway of the target, rewriting all routes installed through it
+func (helper *RouteHelper) SetGateway(target *RouteTarget, gw net.IP) {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	if gw.Equal(target.gw) {
+		return
+	}
+
+	log.Warn().Msgf("TARGET %s: gateway changes from %v to %v", target.name, target.gw, gw)
+
+	installed := make([]*routeData, 0)
+	for _, ipData := range helper.routes {
+		if ipData.target == target {
+			helper.rmRoute(ipData)
+			installed = append(installed, ipData)
+		}
+	}
+
+	target.gw = gw
+
+	for _, ipData := range installed {
+		target.addRoute(ipData.dst)
+	}
+}
+
+// Gateway of the target (nil for device routes)
+func (helper *RouteHelper) Gateway(target *RouteTarget) net.IP {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	return target.gw
+}
+
+// LinkName of the target (link may be re-created)
+func (helper *RouteHelper) LinkName(target *RouteTarget) string {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	return target.linkName()
+}
+
+// transition applies target state change, logs groups moving to other
+// targets and re-installs routes accordingly
+func (helper *RouteHelper) transition(change func()) {
+	before := make(map[GroupID]*RouteTarget, len(helper.groups))
+	for owner := range helper.groups {
+		before[owner] = helper.available(owner)
+	}
+
+	change()
+
+	for owner, group := range helper.groups {
+		if after := helper.available(owner); after != before[owner] {
+			log.Warn().Msgf("sources.%d: routes move from %s to %s",
+				owner, group.describe(before[owner]), group.describe(after))
 		}
-		helper.routes[key] = routeData{
-			dst:    dst,
-			owners: make(map[GroupID]int),
+	}
+
+	for _, ipData := range helper.routes {
+		helper.sync(ipData)
+	}
+}
+
+// Learn adds route for an address observed in DNS traffic. Route is kept
+// (on behalf of the owner) until expiration, even if owner does not resolve it.
+func (helper *RouteHelper) Learn(owner GroupID, dst *net.IPNet, ttl time.Duration) {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	if helper.closed {
+		return
+	}
+
+	helper.checkInit(owner)
+
+	ipData := helper.lookup(dst)
+	expires := time.Now().Add(ttl)
+	if current, exists := ipData.learned[owner]; !exists || current.Before(expires) {
+		ipData.learned[owner] = expires
+		helper.changed = helper.changed || !exists
+	}
+	helper.sync(ipData)
+}
+
+// Expire learned routes with deadline before [now]. Routes left without
+// owners are deleted physically. Returns number of deleted routes.
+func (helper *RouteHelper) Expire(now time.Time) int {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	deleted := 0
+	for key, ipData := range helper.routes {
+		expired := false
+		for owner, expires := range ipData.learned {
+			if expires.Before(now) {
+				delete(ipData.learned, owner)
+				expired = true
+				helper.changed = true
+			}
+		}
+
+		if expired {
+			if ipData.orphaned() {
+				log.Debug().Msgf("Learned route %s expired", key)
+				deleted++
+			}
+			helper.sync(ipData)
 		}
-		helper.routes[key].owners[owner] = 1
-		helper.addRoute(dst, helper.gw, helper.link)
 	}
+
+	return deleted
 }
 
 // Remove single reference to a route. If there are no more owners
 // and references to it, route is deleted physically.
-func (helper *RouteHelper) Remove(owner GroupID, ip net.IP) int {
-	if helper.link == nil || helper.routes == nil {
-		panic("RouteHelper was not initialized with an interface/gateway to use.")
-	}
+func (helper *RouteHelper) Remove(owner GroupID, dst *net.IPNet) int {
+	helper.mu.Lock()
+	defer helper.unlock()
 
-	key := ipstr(ip.String())
+	helper.checkInit(owner)
+
+	key := ipstr(dst.String())
 
 	if ipData, exists := helper.routes[key]; exists {
 		owners := ipData.owners
@@ -155,10 +552,8 @@ func (helper *RouteHelper) Remove(owner GroupID, ip net.IP) int {
 			}
 
 			delete(owners, owner)
-			if len(owners) == 0 {
-				helper.rmRoute(ipData.dst, helper.gw, helper.link)
-				delete(helper.routes, key)
-			}
+			helper.changed = true
+			helper.sync(ipData)
 
 			return 0
 		}
@@ -167,45 +562,208 @@ func (helper *RouteHelper) Remove(owner GroupID, ip net.IP) int {
 	return -1
 }
 
-// Flush to destroy all physical routes set up by this helper
+// Close helper on exit: routes are no longer added by tasks still running
+// (shutdown timeout expired), so that Flush leaves no routes behind
+func (helper *RouteHelper) Close() {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	helper.closed = true
+}
+
+// Flush to destroy all physical routes set up by this helper, and stop exports
 func (helper *RouteHelper) Flush() {
+	helper.mu.Lock()
+	defer helper.unlock()
+
 	if helper.routes != nil {
 		log.Warn().Msg("CLEAR: Performing DELETE on all added routes")
 		for _, ipData := range helper.routes {
-			helper.rmRoute(ipData.dst, helper.gw, helper.link)
+			if ipData.target != nil {
+				helper.rmRoute(ipData)
+			}
 		}
 		helper.routes = make(routesMap)
 	}
+	helper.exporting = false // exported files keep the last table
+}
+
+// Keep routes in place (on exit) and stop exports
+func (helper *RouteHelper) Keep() {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	log.Warn().Msgf("KEEP: leaving %d routes in place", len(helper.routes))
+	helper.exporting = false
+}
+
+// Adopt routes left in place by previous run (on_exit: keep), so they are
+// not re-added. Adopted routes are kept with no owners until ReleaseAdopted.
+// Routes with protocol tag matching no target are stale and deleted.
+func (helper *RouteHelper) Adopt() {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	if helper.closed {
+		return
+	}
+
+	candidates := make(map[string][]*RouteTarget) // by namespace
+	for _, target := range helper.targets {
+		candidates[target.nsName] = append(candidates[target.nsName], target)
+	}
+	for _, killSwitch := range helper.killSwitches {
+		candidates[killSwitch.nsName] = append(candidates[killSwitch.nsName], killSwitch)
+	}
+
+	adopted := 0
+	for nsName, targets := range candidates {
+		handle := targets[0].handle
+		routes, err := handle.RouteListFiltered(netlink.FAMILY_V4,
+			&netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			log.Error().Msgf("ADOPT: unable to list routes (netns \"%s\"): %v", nsName, err)
+			continue
+		}
+
+		for _, route := range routes {
+			var owner *RouteTarget
+			for _, target := range targets {
+				if target.owns(route) {
+					owner = target
+					break
+				}
+			}
+
+			if owner == nil || helper.routes[ipstr(route.Dst.String())] != nil {
+				if route.Protocol == RouteProtocol {
+					log.Info().Msgf("ROUTE DEL: %s (stale)", route.Dst)
+					route.Protocol = 0
+					if err := handle.RouteDel(&route); err != nil {
+						log.Error().Msgf("route_del fail (%s): %v", route.Dst, err)
+					}
+				}
+				continue
+			}
+
+			ipData := helper.lookup(route.Dst)
+			ipData.target = owner
+			ipData.adopted = true
+			ipData.untagged = route.Protocol != RouteProtocol
+			if owner.wireguard != nil {
+				owner.wireguard.add(route.Dst)
+			}
+			adopted++
+		}
+	}
+
+	log.Info().Msgf("ADOPT: %d existing routes", adopted)
+}
+
+// ReleaseAdopted routes after the first update: routes no group wants
+// are deleted, others are moved to targets of their winners if needed
+func (helper *RouteHelper) ReleaseAdopted() {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	released := 0
+	for _, ipData := range helper.routes {
+		if ipData.adopted {
+			ipData.adopted = false
+			if ipData.orphaned() {
+				released++
+			}
+			helper.sync(ipData)
+		}
+	}
+
+	if released > 0 {
+		log.Info().Msgf("ADOPT: %d adopted routes are no longer wanted", released)
+	}
+}
+
+// Count routes in the table, and routes with learned owners
+func (helper *RouteHelper) Count() (routes, learned int) {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	for _, ipData := range helper.routes {
+		if len(ipData.learned) > 0 {
+			learned++
+		}
+	}
+	return len(helper.routes), learned
+}
+
+// Unusable targets (link down or unhealthy), sorted by name
+func (helper *RouteHelper) Unusable() []string {
+	helper.mu.Lock()
+	defer helper.unlock()
+
+	var names []string
+	for name, target := range helper.targets {
+		if !target.usable() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
 // Replace adds multiple routes. Erase all previous routes by this owner.
 // Change reference count to 1 for owner routes.
-func (helper *RouteHelper) Replace(owner GroupID, ips []net.IP) {
+func (helper *RouteHelper) Replace(owner GroupID, dsts []*net.IPNet) {
+	helper.mu.Lock()
+	defer helper.unlock()
 
-	for _, ip := range ips {
-		helper.Add(owner, ip, false)
+	if helper.closed {
+		return
+	}
+
+	wanted := make(map[ipstr]struct{}, len(dsts))
+	for _, dst := range dsts {
+		helper.add(owner, dst, false)
+		wanted[ipstr(dst.String())] = struct{}{}
 	}
 
 	for key, ipData := range helper.routes {
-		owners := ipData.owners
-		if _, ownerExists := owners[owner]; ownerExists {
-			if !containsIP(ips, ipData.dst.IP) {
-				delete(owners, owner)
+		if _, ownerExists := ipData.owners[owner]; ownerExists {
+			if _, keep := wanted[key]; !keep {
+				delete(ipData.owners, owner)
+				helper.changed = true
+				helper.sync(ipData)
 			}
 		}
+	}
+}
 
-		if len(owners) == 0 {
-			delete(helper.routes, key)
-			helper.rmRoute(ipData.dst, helper.gw, helper.link)
-		}
+// describe target used by the group (nil: no usable target)
+func (group groupRoute) describe(target *RouteTarget) string {
+	if target != nil {
+		return "target " + target.name
+	}
+	if group.killSwitch != nil {
+		return "kill switch (" + group.killSwitch.name + ")"
 	}
+	return "none (routes removed)"
 }
 
-func containsIP(ips []net.IP, ip net.IP) bool {
-	for _, _ip := range ips {
-		if ip.Equal(_ip) {
-			return true
+// orphaned route has neither owners nor unexpired learned owners,
+// and is not adopted
+func (ipData *routeData) orphaned() bool {
+	return len(ipData.owners) == 0 && len(ipData.learned) == 0 && !ipData.adopted
+}
+
+// hostRoutes converts addresses to single-host (/32) destinations
+func hostRoutes(ips []net.IP) []*net.IPNet {
+	dsts := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			dsts = append(dsts, &net.IPNet{
+				IP:   ip4,
+				Mask: net.CIDRMask(32, 32),
+			})
 		}
 	}
-	return false
+	return dsts
 }
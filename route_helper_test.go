@@ -0,0 +1,114 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWinner(t *testing.T) {
+	up := &RouteTarget{name: "up", healthy: true, linkUp: true}
+	down := &RouteTarget{name: "down", healthy: true}
+	failed := &RouteTarget{name: "failed", linkUp: true, fallback: []*RouteTarget{down, up}}
+
+	group := func(target *RouteTarget, priority int) groupRoute {
+		return groupRoute{target: target, priority: priority}
+	}
+
+	tests := []struct {
+		name    string
+		groups  map[GroupID]groupRoute
+		owners  []GroupID
+		learned []GroupID
+		want    GroupID
+		found   bool
+	}{
+		{"available first", map[GroupID]groupRoute{0: group(down, 10), 1: group(up, 0)}, []GroupID{0, 1}, nil, 1, true},
+		{"higher priority", map[GroupID]groupRoute{0: group(up, 0), 1: group(up, 5)}, []GroupID{0, 1}, nil, 1, true},
+		{"lower index", map[GroupID]groupRoute{1: group(up, 5), 2: group(up, 5)}, []GroupID{2, 1}, nil, 1, true},
+		{"learned lower index", map[GroupID]groupRoute{1: group(up, 0), 2: group(up, 0)}, []GroupID{2}, []GroupID{1}, 1, true},
+		{"learned available", map[GroupID]groupRoute{0: group(down, 5), 3: group(up, 0)}, []GroupID{0}, []GroupID{3}, 3, true},
+		{"learned higher priority", map[GroupID]groupRoute{0: group(up, 0), 3: group(up, 1)}, []GroupID{0}, []GroupID{3}, 3, true},
+		{"none available", map[GroupID]groupRoute{0: group(down, 0), 1: group(down, 5)}, []GroupID{0, 1}, nil, 1, true},
+		{"fallback available", map[GroupID]groupRoute{0: group(failed, 0), 1: group(down, 5)}, []GroupID{0, 1}, nil, 0, true},
+		{"export only", map[GroupID]groupRoute{0: group(nil, 10), 1: group(up, 0)}, []GroupID{0, 1}, nil, 1, true},
+		{"no owners", map[GroupID]groupRoute{0: group(up, 0)}, nil, nil, 0, false},
+	}
+
+	for _, test := range tests {
+		helper := RouteHelper{groups: test.groups}
+		ipData := &routeData{owners: make(map[GroupID]int), learned: make(map[GroupID]time.Time)}
+		for _, owner := range test.owners {
+			ipData.owners[owner] = 1
+		}
+		for _, owner := range test.learned {
+			ipData.learned[owner] = time.Now().Add(time.Minute)
+		}
+
+		// owners are visited in random (map) order
+		for i := 0; i < 10; i++ {
+			if got, found := helper.winner(ipData); got != test.want || found != test.found {
+				t.Errorf("%s: winner %d (found %v), want %d (found %v)", test.name, got, found, test.want, test.found)
+				break
+			}
+		}
+	}
+}
+
+func TestClosedHelper(t *testing.T) {
+	target := newTestTarget(t, "vpn", 100)
+
+	var helper RouteHelper
+	helper.Reset(map[string]*RouteTarget{"vpn": target})
+	helper.Assign(0, "vpn", 0, KillSwitchOff)
+
+	_, resolved, _ := net.ParseCIDR("203.0.113.1/32")
+	_, learned, _ := net.ParseCIDR("203.0.113.2/32")
+	helper.Replace(0, []*net.IPNet{resolved})
+
+	// task still running after shutdown timeout
+	helper.Close()
+	helper.Flush()
+	helper.Replace(0, []*net.IPNet{resolved})
+	helper.Learn(0, learned, time.Minute)
+
+	if routes := kernelRoutes(t, target); len(routes) > 0 {
+		t.Errorf("routes added after flush: %v", routes)
+	}
+	if count, _ := helper.Count(); count != 0 {
+		t.Errorf("%d routes in the table after flush", count)
+	}
+}
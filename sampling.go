@@ -0,0 +1,131 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sampleLater schedules further samples of the task domain within the
+// update, spread over sample window (round-robin DNS returns a random
+// subset of a large pool per query). Samples run as one-shot tasks, so
+// that the window does not delay other tasks.
+func (task Task) sampleLater(scheduler *Scheduler) {
+	group := task.Group
+	if group.samples == 1 {
+		return
+	}
+
+	pause := group.sampleWindow / time.Duration(group.samples-1)
+	for i := 1; i < group.samples; i++ {
+		scheduler.Once(Task{Group: group, Domain: task.Domain, Sample: i}, pause*time.Duration(i))
+	}
+}
+
+// sampled accumulates successful sample result of the domain, returning
+// answers of all samples within the update so far. Answers of previous
+// update are included until the last sample, so that addresses missing
+// from the first samples keep their routes.
+func (group *Group) sampled(domain string, sample int, result Resolution) Resolution {
+	round, exists := group.rounds[domain]
+	if sample == 0 || !exists {
+		var previous []net.IP
+		if exists {
+			previous = round.result.IPs
+		}
+		round = &samplingRound{result: result, previous: previous}
+		round.result.IPs = append([]net.IP(nil), result.IPs...) // provenance shares the slice
+		round.result.Provenance = make(map[string][]net.IP)
+		group.rounds[domain] = round
+	} else {
+		round.result.IPs = appendNewIPs(round.result.IPs, result.IPs)
+		round.result.Chain = appendNewNames(round.result.Chain, result.Chain)
+		round.result.expire(result.TTL)
+	}
+	for nameserver, ips := range result.Provenance {
+		round.result.Provenance[nameserver] = appendNewIPs(round.result.Provenance[nameserver], ips)
+	}
+	round.answered++
+
+	if sample == group.samples-1 {
+		log.Debug().Msgf("%s: %d addresses from %d/%d samples", domain, len(round.result.IPs), round.answered, group.samples)
+		round.previous = nil // round is complete, kept for the next update
+	}
+
+	merged := round.result
+	if len(round.previous) > 0 {
+		merged.IPs = appendNewIPs(append([]net.IP(nil), round.result.IPs...), round.previous)
+	}
+	return merged
+}
+
+// sight addresses of the domain, returning all addresses seen within
+// retain window (just the addresses, when there is no window)
+func (group *Group) sight(domain string, ips []net.IP) []net.IP {
+	if group.retain == 0 {
+		return ips
+	}
+
+	now := time.Now()
+	sightings, exists := group.sightings[domain]
+	if !exists {
+		sightings = make(map[string]sighting)
+		group.sightings[domain] = sightings
+	}
+	for _, ip := range ips {
+		sightings[ip.String()] = sighting{ip: ip, seen: now}
+	}
+
+	retained := make([]net.IP, 0, len(sightings))
+	for key, seen := range sightings {
+		if now.Sub(seen.seen) > group.retain {
+			delete(sightings, key)
+			continue
+		}
+		retained = append(retained, seen.ip)
+	}
+	if len(sightings) == 0 {
+		delete(group.sightings, domain)
+	}
+
+	sort.Slice(retained, func(i, j int) bool {
+		return bytes.Compare(retained[i].To16(), retained[j].To16()) < 0
+	})
+	return retained
+}
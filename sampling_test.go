@@ -0,0 +1,109 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupSampled(t *testing.T) {
+	group := &Group{samples: 3, rounds: make(map[string]*samplingRound)}
+	answer := func(ttl uint32, ips ...string) Resolution {
+		result := newResolution("pool.example.com")
+		result.TTL = ttl
+		for _, ip := range ips {
+			result.IPs = append(result.IPs, net.ParseIP(ip))
+		}
+		result.Provenance = map[string][]net.IP{"192.0.2.53": result.IPs}
+		return result
+	}
+
+	// addresses of previous update stay routed until the update completes
+	// addresses of previous update stay routed until the update completes
+	tests := []struct {
+		sample     int
+		answer     Resolution
+		want       []string
+		ttl        uint32
+		provenance int // answers of the update itself
+	}{
+		{0, answer(60, "203.0.113.1", "203.0.113.2"), []string{"203.0.113.1", "203.0.113.2"}, 60, 2},
+		{1, answer(30, "203.0.113.2", "203.0.113.3"), []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"}, 30, 3},
+		{2, answer(90, "203.0.113.4"), []string{"203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4"}, 30, 4},
+		{0, answer(60, "203.0.113.5"), []string{"203.0.113.5", "203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4"}, 60, 1}, // next update
+		{1, answer(60, "203.0.113.1"), []string{"203.0.113.5", "203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4"}, 60, 2},
+		{2, answer(60, "203.0.113.6"), []string{"203.0.113.5", "203.0.113.1", "203.0.113.6"}, 60, 3},
+	}
+
+	for _, test := range tests {
+		result := group.sampled("pool.example.com", test.sample, test.answer)
+		var got []string
+		for _, ip := range result.IPs {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual(got, test.want) || result.TTL != test.ttl {
+			t.Errorf("sample %d: %v (TTL %d), want %v (TTL %d)", test.sample, got, result.TTL, test.want, test.ttl)
+		}
+		if len(result.Provenance["192.0.2.53"]) != test.provenance {
+			t.Errorf("sample %d: provenance %v", test.sample, result.Provenance)
+		}
+	}
+
+	if _, exists := group.rounds["pool.example.com"]; !exists {
+		t.Error("round of the next update is not kept")
+	}
+}
+
+func TestTaskSampleLater(t *testing.T) {
+	group := &Group{samples: 3, sampleWindow: 2 * time.Second}
+	scheduler := NewScheduler()
+	Task{Group: group, Domain: "pool.example.com"}.sampleLater(scheduler)
+
+	if scheduler.Len() != 2 {
+		t.Fatalf("%d samples scheduled, want 2", scheduler.Len())
+	}
+	for sample, delay := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second} {
+		entry := scheduler.tasks[Task{Group: group, Domain: "pool.example.com", Sample: sample}]
+		if entry == nil || !entry.once {
+			t.Errorf("sample %d is not scheduled once", sample)
+			continue
+		}
+		if wait := time.Until(entry.next); wait > delay || wait < delay-time.Second/2 {
+			t.Errorf("sample %d runs in %v, want %v", sample, wait, delay)
+		}
+	}
+}
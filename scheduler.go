@@ -0,0 +1,263 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// scheduledTask is an entry of the scheduler queue
+type scheduledTask struct {
+	task     Task
+	next     time.Time
+	interval time.Duration
+	jitter   time.Duration
+	once     bool // removed after the run
+	index    int  // position in the queue
+}
+
+// taskQueue is a min-heap of tasks by next run time
+type taskQueue []*scheduledTask
+
+func (queue taskQueue) Len() int           { return len(queue) }
+func (queue taskQueue) Less(i, j int) bool { return queue[i].next.Before(queue[j].next) }
+
+func (queue taskQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].index = i
+	queue[j].index = j
+}
+
+func (queue *taskQueue) Push(x interface{}) {
+	entry := x.(*scheduledTask)
+	entry.index = len(*queue)
+	*queue = append(*queue, entry)
+}
+
+func (queue *taskQueue) Pop() interface{} {
+	old := *queue
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return entry
+}
+
+// Scheduler runs tasks (group domains) at their next run time. Each run
+// schedules the next one after interval plus random jitter, so that
+// domains of a group do not hit the resolver at once.
+type Scheduler struct {
+	mu     sync.Mutex
+	queue  taskQueue
+	tasks  map[Task]*scheduledTask
+	random *rand.Rand
+	wake   chan struct{} // queue head changed
+}
+
+// NewScheduler with empty queue
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		tasks:  make(map[Task]*scheduledTask),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Add task running every interval (plus random jitter), first run is
+// one interval away. Adding existing task updates its interval.
+func (scheduler *Scheduler) Add(task Task, interval, jitter time.Duration) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	entry, exists := scheduler.tasks[task]
+	if !exists {
+		entry = &scheduledTask{task: task}
+		scheduler.tasks[task] = entry
+	}
+	entry.interval = interval
+	entry.jitter = jitter
+	entry.next = time.Now().Add(scheduler.delay(entry))
+
+	if exists {
+		heap.Fix(&scheduler.queue, entry.index)
+	} else {
+		heap.Push(&scheduler.queue, entry)
+	}
+	scheduler.notify()
+}
+
+// Once runs the task after delay, then removes it. Existing task is
+// rescheduled (and stays one-shot).
+func (scheduler *Scheduler) Once(task Task, delay time.Duration) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	entry, exists := scheduler.tasks[task]
+	if !exists {
+		entry = &scheduledTask{task: task, once: true}
+		scheduler.tasks[task] = entry
+	}
+	entry.next = time.Now().Add(delay)
+
+	if exists {
+		heap.Fix(&scheduler.queue, entry.index)
+	} else {
+		heap.Push(&scheduler.queue, entry)
+	}
+	scheduler.notify()
+}
+
+// Remove task from the schedule
+func (scheduler *Scheduler) Remove(task Task) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if entry, exists := scheduler.tasks[task]; exists {
+		heap.Remove(&scheduler.queue, entry.index)
+		delete(scheduler.tasks, task)
+		scheduler.notify()
+	}
+}
+
+// RunAt changes next run time of the task
+func (scheduler *Scheduler) RunAt(task Task, next time.Time) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if entry, exists := scheduler.tasks[task]; exists {
+		entry.next = next
+		heap.Fix(&scheduler.queue, entry.index)
+		scheduler.notify()
+	}
+}
+
+// RunAfter delay plus random jitter, instead of next run time of the task
+func (scheduler *Scheduler) RunAfter(task Task, delay, jitter time.Duration) {
+	scheduler.mu.Lock()
+	if jitter > 0 {
+		delay += time.Duration(scheduler.random.Int63n(int64(jitter)))
+	}
+	scheduler.mu.Unlock()
+
+	scheduler.RunAt(task, time.Now().Add(delay))
+}
+
+// Len tells number of scheduled tasks
+func (scheduler *Scheduler) Len() int {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	return len(scheduler.queue)
+}
+
+// delay until next run: interval plus random jitter
+func (scheduler *Scheduler) delay(entry *scheduledTask) time.Duration {
+	delay := entry.interval
+	if entry.jitter > 0 {
+		delay += time.Duration(scheduler.random.Int63n(int64(entry.jitter)))
+	}
+	return delay
+}
+
+func (scheduler *Scheduler) notify() {
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due pops task which run time has come (rescheduling it, unless it is
+// one-shot), or tells how long to wait for the next one
+func (scheduler *Scheduler) due(now time.Time) (Task, bool, time.Duration) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if len(scheduler.queue) == 0 {
+		return Task{}, false, time.Hour
+	}
+
+	entry := scheduler.queue[0]
+	if wait := entry.next.Sub(now); wait > 0 {
+		return Task{}, false, wait
+	}
+
+	if entry.once {
+		heap.Remove(&scheduler.queue, entry.index)
+		delete(scheduler.tasks, entry.task)
+		return entry.task, true, 0
+	}
+
+	entry.next = now.Add(scheduler.delay(entry))
+	heap.Fix(&scheduler.queue, entry.index)
+	return entry.task, true, 0
+}
+
+// Run sends due tasks to the channel until context is cancelled,
+// then closes the channel
+func (scheduler *Scheduler) Run(ctx context.Context, out chan<- Task) {
+	defer close(out)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		task, ready, wait := scheduler.due(time.Now())
+		if ready {
+			select {
+			case out <- task:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-scheduler.wake:
+		case <-timer.C:
+		}
+	}
+}
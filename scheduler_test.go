@@ -0,0 +1,154 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerOnce(t *testing.T) {
+	group := &Group{}
+	periodic := Task{Group: group, Domain: "example.com"}
+	sample := Task{Group: group, Domain: "example.com", Sample: 1}
+
+	scheduler := NewScheduler()
+	scheduler.Add(periodic, time.Hour, 0)
+	scheduler.Once(sample, 10*time.Millisecond)
+	if scheduler.Len() != 2 {
+		t.Fatalf("%d tasks scheduled, want 2", scheduler.Len())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	out := make(chan Task)
+	go scheduler.Run(ctx, out)
+
+	var runs []Task
+	for task := range out {
+		runs = append(runs, task)
+	}
+
+	if len(runs) != 1 || runs[0] != sample {
+		t.Errorf("ran %v, want one-shot task only", runs)
+	}
+	if scheduler.Len() != 1 {
+		t.Errorf("%d tasks scheduled after one-shot run, want 1", scheduler.Len())
+	}
+}
+
+func TestSchedulerPeriodic(t *testing.T) {
+	task := Task{Group: &Group{}, Domain: "example.com"}
+	scheduler := NewScheduler()
+	scheduler.Add(task, 20*time.Millisecond, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	out := make(chan Task)
+	go scheduler.Run(ctx, out)
+
+	var runs []time.Time
+	for range out {
+		runs = append(runs, time.Now())
+	}
+
+	if len(runs) < 3 || len(runs) > 7 {
+		t.Errorf("%d runs in 150ms, want about 7 (interval 20ms)", len(runs))
+	}
+	for i := 1; i < len(runs); i++ {
+		if gap := runs[i].Sub(runs[i-1]); gap < 15*time.Millisecond {
+			t.Errorf("run %d after %v, want interval 20ms", i, gap)
+		}
+	}
+	if scheduler.Len() != 1 {
+		t.Errorf("%d tasks scheduled, want periodic task kept", scheduler.Len())
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	task := Task{Group: &Group{}, Domain: "example.com"}
+	scheduler := NewScheduler()
+	scheduler.Add(task, time.Minute, 10*time.Second)
+
+	entry := scheduler.tasks[task]
+	for i := 0; i < 100; i++ {
+		now := entry.next
+		if due, ready, _ := scheduler.due(now); !ready || due != task {
+			t.Fatalf("task is not due at its run time")
+		}
+		if delay := entry.next.Sub(now); delay < time.Minute || delay >= time.Minute+10*time.Second {
+			t.Fatalf("next run in %v, want interval 1m plus jitter below 10s", delay)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		before := time.Now()
+		scheduler.RunAfter(task, time.Second, time.Second)
+		if delay := entry.next.Sub(before); delay < time.Second || delay >= 2*time.Second+time.Second/10 {
+			t.Fatalf("retry in %v, want 1s plus jitter below 1s", delay)
+		}
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	task := Task{Group: &Group{}, Domain: "example.com"}
+
+	for _, due := range []bool{true, false} {
+		scheduler := NewScheduler()
+		scheduler.Add(task, time.Hour, 0)
+		if due {
+			scheduler.RunAt(task, time.Now()) // nobody receives it
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		out := make(chan Task)
+		stopped := make(chan struct{})
+		go func() {
+			scheduler.Run(ctx, out)
+			close(stopped)
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("due task %v: scheduler runs after cancel", due)
+		}
+		if _, open := <-out; open {
+			t.Errorf("due task %v: channel is open after cancel", due)
+		}
+	}
+}
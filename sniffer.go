@@ -0,0 +1,257 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	dns_impl "github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// packetSource reads captured IP packets (without link layer header).
+// Empty packet with no error means read timeout.
+type packetSource interface {
+	ReadPacket() ([]byte, error)
+	Close() error
+}
+
+func (sniffer *Sniffer) init() error {
+	if len(sniffer.Interface) == 0 && len(sniffer.Pcap) == 0 {
+		return errors.New("sniffer.interface (or sniffer.pcap to replay) is not specified")
+	}
+
+	var err error
+	sniffer.grace, err = parseGrace("sniffer.grace", sniffer.Grace)
+	if err != nil {
+		return err
+	}
+
+	if len(sniffer.Pcap) > 0 {
+		sniffer.source, err = openPcap(sniffer.Pcap)
+	} else {
+		sniffer.source, err = openCapture(sniffer.Interface)
+	}
+
+	return err
+}
+
+// Start capture loop, which stops on State.Stop or end of pcap file
+func (sniffer *Sniffer) Start(state *State) {
+	if len(sniffer.Pcap) > 0 {
+		log.Info().Msgf("DNS sniffer replaying %s", sniffer.Pcap)
+	} else {
+		log.Info().Msgf("DNS sniffer capturing on %s", sniffer.Interface)
+	}
+
+	state.goroutine(func() {
+		defer sniffer.source.Close()
+
+		for {
+			select {
+			case <-state.ctx.Done():
+				return
+			default:
+			}
+
+			packet, err := sniffer.source.ReadPacket()
+			if err == io.EOF {
+				log.Info().Msg("DNS sniffer: end of capture")
+				return
+			} else if err != nil {
+				log.Error().Msgf("DNS sniffer read fail: %v", err)
+				return
+			}
+
+			if reply := parseDNSResponse(packet); reply != nil {
+				state.Learn(reply, sniffer.grace)
+			}
+		}
+	})
+}
+
+// parseDNSResponse extracts DNS response from IPv4/IPv6 UDP packet
+// with source port 53. Returns nil for any other packet.
+func parseDNSResponse(packet []byte) *dns_impl.Msg {
+	var udp []byte
+
+	if len(packet) == 0 {
+		return nil
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || ihl < 20 || len(packet) < ihl || packet[9] != 17 {
+			return nil
+		}
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+			return nil // fragmented
+		}
+		udp = packet[ihl:]
+	case 6:
+		if len(packet) < 40 || packet[6] != 17 {
+			return nil
+		}
+		udp = packet[40:]
+	default:
+		return nil
+	}
+
+	if len(udp) < 8 || binary.BigEndian.Uint16(udp[0:2]) != 53 {
+		return nil
+	}
+
+	msg := new(dns_impl.Msg)
+	if err := msg.Unpack(udp[8:]); err != nil || !msg.Response {
+		return nil
+	}
+
+	return msg
+}
+
+// pcap link types
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+// pcapFile replays packets from (classic, not pcapng) capture file
+type pcapFile struct {
+	file     *os.File
+	reader   *bufio.Reader
+	order    binary.ByteOrder
+	linkType uint32
+}
+
+func openPcap(path string) (*pcapFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pcap := &pcapFile{file: file, reader: bufio.NewReader(file)}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(pcap.reader, header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("pcap %s: %v", path, err)
+	}
+
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		pcap.order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		pcap.order = binary.BigEndian
+	default:
+		file.Close()
+		return nil, fmt.Errorf("pcap %s: unsupported file format", path)
+	}
+
+	pcap.linkType = pcap.order.Uint32(header[20:24]) & 0x0fffffff
+	switch pcap.linkType {
+	case linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL, linkTypeIPv4, linkTypeIPv6:
+	default:
+		file.Close()
+		return nil, fmt.Errorf("pcap %s: unsupported link type %d", path, pcap.linkType)
+	}
+
+	return pcap, nil
+}
+
+func (pcap *pcapFile) ReadPacket() ([]byte, error) {
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(pcap.reader, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return nil, err
+		}
+
+		data := make([]byte, pcap.order.Uint32(header[8:12]))
+		if _, err := io.ReadFull(pcap.reader, data); err != nil {
+			return nil, io.EOF
+		}
+
+		if packet := pcap.stripLinkLayer(data); packet != nil {
+			return packet, nil
+		}
+	}
+}
+
+// stripLinkLayer returns IP packet, or nil for non-IP frames
+func (pcap *pcapFile) stripLinkLayer(data []byte) []byte {
+	var offset, etherType int
+
+	switch pcap.linkType {
+	case linkTypeEthernet:
+		offset = 14
+		if len(data) >= offset {
+			etherType = int(binary.BigEndian.Uint16(data[12:14]))
+			for etherType == 0x8100 || etherType == 0x88a8 {
+				offset += 4
+				if len(data) < offset {
+					return nil
+				}
+				etherType = int(binary.BigEndian.Uint16(data[offset-2 : offset]))
+			}
+		}
+	case linkTypeLinuxSLL:
+		offset = 16
+		if len(data) >= offset {
+			etherType = int(binary.BigEndian.Uint16(data[14:16]))
+		}
+	default:
+		return data
+	}
+
+	if len(data) < offset || (etherType != 0x0800 && etherType != 0x86dd) {
+		return nil
+	}
+
+	return data[offset:]
+}
+
+func (pcap *pcapFile) Close() error {
+	return pcap.file.Close()
+}
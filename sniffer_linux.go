@@ -0,0 +1,133 @@
+//go:build linux
+
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// captureTimeout lets capture loop check for Stop between packets
+const captureTimeout = time.Second
+
+// dnsResponseFilter accepts UDP packets from port 53 (IPv4 and IPv6).
+// Socket is SOCK_DGRAM, so packets start with IP header.
+var dnsResponseFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 0, Size: 1},
+	bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 4},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: 7},
+	// IPv4: UDP, not a fragment, source port 53
+	bpf.LoadAbsolute{Off: 9, Size: 1},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipFalse: 10},
+	bpf.LoadAbsolute{Off: 6, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x3fff, SkipTrue: 8},
+	bpf.LoadMemShift{Off: 0},
+	bpf.LoadIndirect{Off: 0, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipTrue: 4, SkipFalse: 5},
+	// IPv6: UDP (no extension headers), source port 53
+	bpf.LoadAbsolute{Off: 6, Size: 1},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipFalse: 3},
+	bpf.LoadAbsolute{Off: 40, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipFalse: 1},
+	bpf.RetConstant{Val: 0xffff},
+	bpf.RetConstant{Val: 0},
+}
+
+// afpacketSource captures packets on the interface with AF_PACKET socket
+type afpacketSource struct {
+	fd     int
+	buffer []byte
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func openCapture(iface string) (packetSource, error) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("sniffer.interface \"%s\": %v", iface, err)
+	}
+
+	filter, err := bpf.Assemble(dnsResponseFilter)
+	if err != nil {
+		return nil, fmt.Errorf("BPF filter: %v", err)
+	}
+	program := make([]unix.SockFilter, len(filter))
+	for i, instruction := range filter {
+		program[i] = unix.SockFilter{Code: instruction.Op, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("AF_PACKET socket: %v", err)
+	}
+
+	err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER,
+		&unix.SockFprog{Len: uint16(len(program)), Filter: &program[0]})
+	if err == nil {
+		tv := unix.NsecToTimeval(captureTimeout.Nanoseconds())
+		err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	}
+	if err == nil {
+		err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: link.Index})
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("AF_PACKET socket setup on %s: %v", iface, err)
+	}
+
+	return &afpacketSource{fd: fd, buffer: make([]byte, 65536)}, nil
+}
+
+func (source *afpacketSource) ReadPacket() ([]byte, error) {
+	n, _, err := unix.Recvfrom(source.fd, source.buffer, 0)
+	if err == unix.EAGAIN || err == unix.EINTR {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return source.buffer[:n], nil
+}
+
+func (source *afpacketSource) Close() error {
+	return unix.Close(source.fd)
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestDNSResponseFilter(t *testing.T) {
+	vm, err := bpf.NewVM(dnsResponseFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := dnsReply(t, "example.com", "example.com. 60 IN A 203.0.113.1")
+	fragment := ipv4Packet(17, udpPayload(t, reply, 53), 0)
+	fragment[7] = 0x10 // fragment offset
+
+	tests := []struct {
+		name   string
+		packet []byte
+		accept bool
+	}{
+		{"ipv4 reply", ipv4Packet(17, udpPayload(t, reply, 53), 0), true},
+		{"ipv4 reply with options", ipv4Packet(17, udpPayload(t, reply, 53), 12), true},
+		{"ipv6 reply", ipv6Packet(17, udpPayload(t, reply, 53)), true},
+		{"ipv4 other port", ipv4Packet(17, udpPayload(t, reply, 123), 0), false},
+		{"ipv6 other port", ipv6Packet(17, udpPayload(t, reply, 123)), false},
+		{"ipv4 tcp", ipv4Packet(6, udpPayload(t, reply, 53), 0), false},
+		{"ipv6 tcp", ipv6Packet(6, udpPayload(t, reply, 53)), false},
+		{"fragment", fragment, false},
+	}
+
+	for _, test := range tests {
+		accepted, err := vm.Run(test.packet)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if (accepted > 0) != test.accept {
+			t.Errorf("%s: accepted %d bytes, want accept %v", test.name, accepted, test.accept)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	dns_impl "github.com/miekg/dns"
+)
+
+// dnsReply for the name with answer records (zone file syntax)
+func dnsReply(t *testing.T, name string, records ...string) *dns_impl.Msg {
+	msg := new(dns_impl.Msg)
+	msg.SetQuestion(dns_impl.Fqdn(name), dns_impl.TypeA)
+	msg.Response = true
+	for _, record := range records {
+		rr, err := dns_impl.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	return msg
+}
+
+// udpPayload makes UDP datagram (checksum not set) with the message
+func udpPayload(t *testing.T, msg *dns_impl.Msg, srcPort uint16) []byte {
+	payload, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], 40000)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	return append(udp, payload...)
+}
+
+// ipv4Packet wraps the payload into IPv4 header (with [options] bytes)
+func ipv4Packet(protocol byte, payload []byte, options int) []byte {
+	ihl := 20 + options
+	packet := make([]byte, ihl, ihl+len(payload))
+	packet[0] = 0x40 | byte(ihl/4)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(ihl+len(payload)))
+	packet[8] = 64
+	packet[9] = protocol
+	copy(packet[12:16], net.IPv4(8, 8, 8, 8).To4())
+	copy(packet[16:20], net.IPv4(192, 168, 1, 10).To4())
+	return append(packet, payload...)
+}
+
+// ipv6Packet wraps the payload into IPv6 header
+func ipv6Packet(protocol byte, payload []byte) []byte {
+	packet := make([]byte, 40, 40+len(payload))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(payload)))
+	packet[6] = protocol
+	packet[7] = 64
+	copy(packet[8:24], net.ParseIP("2001:db8::53"))
+	copy(packet[24:40], net.ParseIP("2001:db8::10"))
+	return append(packet, payload...)
+}
+
+// ethernetFrame wraps the packet, with 802.1Q tag if [vlan] is set
+func ethernetFrame(etherType uint16, packet []byte, vlan bool) []byte {
+	frame := make([]byte, 12, 18+len(packet))
+	if vlan {
+		frame = append(frame, 0x81, 0x00, 0x00, 0x0a)
+	}
+	frame = append(frame, byte(etherType>>8), byte(etherType))
+	return append(frame, packet...)
+}
+
+// writePcap writes classic little-endian capture file
+func writePcap(t *testing.T, linkType uint32, frames ...[]byte) string {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], linkType)
+
+	data := header
+	for i, frame := range frames {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], uint32(1700000000+i))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(frame)))
+		data = append(append(data, record...), frame...)
+	}
+
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	reply := dnsReply(t, "example.com", "example.com. 60 IN A 203.0.113.1")
+	query := dnsReply(t, "example.com")
+	query.Response = false
+
+	fragment := ipv4Packet(17, udpPayload(t, reply, 53), 0)
+	binary.BigEndian.PutUint16(fragment[6:8], 0x2000) // more fragments
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"ipv4 reply", ipv4Packet(17, udpPayload(t, reply, 53), 0), true},
+		{"ipv4 reply with options", ipv4Packet(17, udpPayload(t, reply, 53), 8), true},
+		{"ipv6 reply", ipv6Packet(17, udpPayload(t, reply, 53)), true},
+		{"query", ipv4Packet(17, udpPayload(t, query, 53), 0), false},
+		{"other port", ipv4Packet(17, udpPayload(t, reply, 5353), 0), false},
+		{"tcp", ipv4Packet(6, udpPayload(t, reply, 53), 0), false},
+		{"fragment", fragment, false},
+		{"short", ipv4Packet(17, nil, 0)[:12], false},
+		{"garbage payload", ipv4Packet(17, []byte{0, 53, 0, 1, 0, 12, 0, 0, 1, 2, 3, 4}, 0), false},
+		{"empty", nil, false},
+	}
+
+	for _, test := range tests {
+		msg := parseDNSResponse(test.packet)
+		if (msg != nil) != test.want {
+			t.Errorf("%s: parsed %v, want %v", test.name, msg != nil, test.want)
+			continue
+		}
+		if msg != nil && len(msg.Answer) != 1 {
+			t.Errorf("%s: %d answer records, want 1", test.name, len(msg.Answer))
+		}
+	}
+}
+
+func TestSnifferPcapReplay(t *testing.T) {
+	cdn := dnsReply(t, "www.example.com",
+		"www.example.com. 300 IN CNAME edge.cdn.net.",
+		"edge.cdn.net. 60 IN A 203.0.113.5")
+	other := dnsReply(t, "other.org", "other.org. 60 IN A 198.51.100.1")
+	v6 := dnsReply(t, "api.example.com", "api.example.com. 60 IN A 203.0.113.6")
+
+	path := writePcap(t, linkTypeEthernet,
+		ethernetFrame(0x0800, ipv4Packet(17, udpPayload(t, cdn, 53), 0), true),
+		ethernetFrame(0x0806, make([]byte, 28), false), // ARP
+		ethernetFrame(0x0800, ipv4Packet(17, udpPayload(t, other, 53), 0), false),
+		ethernetFrame(0x86dd, ipv6Packet(17, udpPayload(t, v6, 53)), false),
+	)
+
+	state := newTestState(t, []string{"www.example.com", "api.example.com"}, []string{"*.cdn.net"})
+	sniffer := &Sniffer{Pcap: path}
+	if err := sniffer.init(); err != nil {
+		t.Fatal(err)
+	}
+	sniffer.Start(state)
+	state.wg.Wait() // replay ends at the end of file
+
+	want := map[string][]GroupID{
+		"203.0.113.5/32": {0, 1},
+		"203.0.113.6/32": {0},
+	}
+	if got := learnedRoutes(state); !reflect.DeepEqual(got, want) {
+		t.Errorf("learned %v, want %v", got, want)
+	}
+}
+
+func TestPcapLinkTypes(t *testing.T) {
+	reply := dnsReply(t, "example.com", "example.com. 60 IN A 203.0.113.1")
+	packet := ipv4Packet(17, udpPayload(t, reply, 53), 0)
+
+	sll := make([]byte, 16)
+	binary.BigEndian.PutUint16(sll[14:16], 0x0800)
+
+	for linkType, frame := range map[uint32][]byte{
+		linkTypeRaw:      packet,
+		linkTypeIPv4:     packet,
+		linkTypeLinuxSLL: append(sll, packet...),
+	} {
+		pcap, err := openPcap(writePcap(t, linkType, frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := pcap.ReadPacket()
+		pcap.Close()
+		if err != nil || parseDNSResponse(got) == nil {
+			t.Errorf("link type %d: packet %x, error %v", linkType, got, err)
+		}
+	}
+}
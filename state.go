@@ -34,70 +34,218 @@
 package main
 
 import (
-	"reflect"
+	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-// Start tickers and polling from group timers, so that the [master] channel
-// will receive tasks
-func (state *State) Start() {
-	if state.tickers != nil {
-		panic("Start may not be used twice")
+// DefaultShutdownTimeout limits waiting for background tasks on exit
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Run initial update of all groups, then scheduled tasks until [ctx]
+// is cancelled (or Stop), and Cleanup. With on_exit: keep, routes left
+// by previous run are adopted for the initial update. Listeners are bound
+// first: failure to bind is returned before any route is installed.
+func (state *State) Run(ctx context.Context) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			state.Stop()
+		case <-state.ctx.Done():
+		}
+	}()
+
+	if err := state.Bind(); err != nil {
+		state.Cleanup()
+		return err
 	}
 
-	state.tickers = make([]*time.Ticker, len(state.groups))
-	for i, group := range state.groups {
-		state.tickers[i] = time.NewTicker(group.interval)
+	if state.onExit == OnExitKeep {
+		state.helper.Adopt()
 	}
+	state.UpdateAll()
+	if state.ctx.Err() == nil {
+		state.helper.ReleaseAdopted()
+		state.Start()
+		state.systemd.Ready(state.status())
 
-	go func() {
-		cases := make([]reflect.SelectCase, len(state.groups))
-		for i, t := range state.tickers {
-			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.C)}
+		log.Info().Msg("Entered the loop")
+		state.loop()
+	}
+
+	state.Cleanup()
+	return nil
+}
+
+// Bind listening sockets of the DNS forwarder and dnstap listener
+func (state *State) Bind() error {
+	defer state.systemd.closeUnused()
+
+	if state.forwarder != nil {
+		if err := state.forwarder.Bind(state); err != nil {
+			return err
 		}
+	}
+	if state.dnstap != nil {
+		if err := state.dnstap.Bind(state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loop runs scheduled tasks until Stop, with systemd watchdog pings
+// and status updates in between
+func (state *State) loop() {
+	var watchdog <-chan time.Time
+	if state.systemd.watchdog > 0 {
+		ticker := time.NewTicker(state.systemd.watchdog)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	for {
+		select {
+		case task, ok := <-state.GetChan():
+			if !ok {
+				return
+			}
+			task.Run(state)
+		case <-watchdog:
+			state.systemd.Watchdog()
+		}
+		state.systemd.Status(state.status())
+	}
+}
+
+// status line: route counts and targets with no usable link
+func (state *State) status() string {
+	routes, learned := state.helper.Count()
+	status := fmt.Sprintf("%d routes (%d learned) of %d groups", routes, learned, len(state.groups))
+
+	if down := state.helper.Unusable(); len(down) > 0 {
+		status += ", unusable targets: " + strings.Join(down, ", ")
+	}
+	return status
+}
 
-		for {
-			index, _, _ := reflect.Select(cases)
-			group := &state.groups[index]
-			state.master <- group
+// Start scheduler of group domains, so that the [master] channel
+// will receive tasks
+func (state *State) Start() {
+	if state.scheduler != nil {
+		panic("Start may not be used twice")
+	}
 
-			select {
-			case <-state.quit:
-				break
-			default:
+	state.scheduler = NewScheduler()
+	for i := range state.groups {
+		group := &state.groups[i]
+		for _, task := range group.Tasks() {
+			state.scheduler.Add(task, group.interval, group.jitter)
+			if len(task.Domain) > 0 {
+				task.retry(state.scheduler) // failed on initial update
+				task.sampleLater(state.scheduler)
 			}
 		}
+	}
+
+	state.goroutine(func() {
+		state.scheduler.Run(state.ctx, state.master)
+	})
+
+	if state.forwarder != nil {
+		state.forwarder.Start(state)
+	}
+	if state.sniffer != nil {
+		state.sniffer.Start(state)
+	}
+	if state.dnstap != nil {
+		state.dnstap.Start(state)
+	}
+	if state.queryLog != nil {
+		state.queryLog.Start(state)
+	}
+	if state.openvpnPush != nil {
+		state.openvpnPush.Start(state)
+	}
+	for _, export := range state.exports {
+		export.Start(state)
+	}
+	if state.bgp != nil {
+		state.bgp.Start(state)
+	}
+	state.helper.StartExports()
+	state.goroutine(state.expireLearned) // CNAME chains of resolved domains are learned too
+	state.watchLinks()
+	for _, target := range state.helper.targets {
+		if target.health != nil {
+			target := target
+			state.goroutine(func() {
+				state.probeTarget(target)
+			})
+		}
+	}
+}
+
+// goroutine runs background task of the State, waited for on Cleanup
+func (state *State) goroutine(task func()) {
+	state.wg.Add(1)
+	go func() {
+		defer state.wg.Done()
+		task()
 	}()
 }
 
-// Cleanup disposes of any resource or goroutine created internaly by State
+// Cleanup stops the State and waits for background tasks (up to shutdown
+// timeout), then deletes routes, or leaves them in place with "on_exit: keep"
 func (state *State) Cleanup() {
-	state.helper.Flush()
-	state.tickers = make([]*time.Ticker, 0)
-	state.groups = make([]Group, 0)
-	close(state.quit)
+	state.systemd.Stopping()
+	state.Stop()
+	if state.forwarder != nil {
+		state.forwarder.Shutdown()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		state.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(state.shutdownTimeout):
+		log.Warn().Msgf("Shutdown timeout (%v) expired, some background tasks are still running", state.shutdownTimeout)
+	}
+
+	state.helper.Close()
+	if state.onExit == OnExitKeep {
+		state.helper.Keep()
+	} else {
+		state.helper.Flush()
+	}
 }
 
-// GetChan to use as task output channel (receive groups to update in time)
-func (state *State) GetChan() chan *Group {
+// GetChan to use as task output channel (receive tasks to run in time),
+// closed on Stop
+func (state *State) GetChan() chan Task {
 	return state.master
 }
 
 // UpdateAll performs out-of-order update of each source group
 func (state *State) UpdateAll() {
 	log.Info().Msgf("Initial update of %d groups.", len(state.groups))
-	for _, group := range state.groups {
-		group.Update(state)
+	for i := range state.groups {
+		if state.ctx.Err() != nil {
+			return
+		}
+		state.groups[i].Update(state)
 	}
 }
 
-// Stop to interrupt channel, stop all tickers and further tasks
+// Stop scheduler (closing the channel), DNS queries in progress and
+// further tasks. It is safe to call Stop multiple times.
 func (state *State) Stop() {
-	for _, t := range state.tickers {
-		t.Stop()
-	}
-	close(state.master)
-	state.quit <- struct{}{}
+	state.cancel()
 }
@@ -0,0 +1,78 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+)
+
+// newTestState makes State with groups of the domains (names and patterns),
+// all on a target with link down: routes are tracked, but not installed
+func newTestState(t *testing.T, domains ...[]string) *State {
+	state := &State{systemd: &Systemd{}}
+	state.ctx, state.cancel = context.WithCancel(context.Background())
+	t.Cleanup(state.cancel)
+
+	state.helper.Reset(map[string]*RouteTarget{"test": {name: "test"}})
+	state.domains = newDomainTrie()
+	for i, names := range domains {
+		owner := GroupID(i)
+		state.groups = append(state.groups, Group{index: owner})
+		for _, name := range names {
+			state.domains.Insert(name, owner)
+		}
+		state.helper.Assign(owner, "test", 0, KillSwitchOff)
+	}
+
+	return state
+}
+
+// learnedRoutes of the State: destination -> groups it was learned for
+func learnedRoutes(state *State) map[string][]GroupID {
+	state.helper.mu.Lock()
+	defer state.helper.mu.Unlock()
+
+	routes := make(map[string][]GroupID)
+	for key, ipData := range state.helper.routes {
+		for owner := range ipData.learned {
+			routes[string(key)] = append(routes[string(key)], owner)
+		}
+		sort.Slice(routes[string(key)], func(i, j int) bool {
+			return routes[string(key)][i] < routes[string(key)][j]
+		})
+	}
+	return routes
+}
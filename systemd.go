@@ -0,0 +1,291 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// listenFdsStart is the first socket-activated file descriptor
+const listenFdsStart = 3
+
+// newSystemd reads notification socket, watchdog and socket-activated
+// listeners passed by systemd in environment
+func newSystemd() *Systemd {
+	systemd := &Systemd{socket: os.Getenv("NOTIFY_SOCKET")}
+
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			systemd.watchdog = time.Duration(usec) * time.Microsecond / 2
+		}
+	}
+
+	if pid := os.Getenv("LISTEN_PID"); pid == strconv.Itoa(os.Getpid()) {
+		count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < count; i++ {
+			name := fmt.Sprintf("LISTEN_FD_%d", listenFdsStart+i)
+			if i < len(names) && len(names[i]) > 0 {
+				name = names[i]
+			}
+			syscall.CloseOnExec(listenFdsStart + i)
+			systemd.activated(os.NewFile(uintptr(listenFdsStart+i), name))
+		}
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return systemd
+}
+
+// activated socket is kept as listener (stream) or packet connection (datagram)
+func (systemd *Systemd) activated(file *os.File) {
+	defer file.Close() // net package uses duplicate descriptor
+
+	if listener, err := net.FileListener(file); err == nil {
+		log.Debug().Msgf("systemd: socket %s listens on %s/%s", file.Name(), listener.Addr().Network(), listener.Addr())
+		systemd.listeners = append(systemd.listeners, listener)
+		return
+	}
+	if conn, err := net.FilePacketConn(file); err == nil {
+		log.Debug().Msgf("systemd: socket %s listens on %s/%s", file.Name(), conn.LocalAddr().Network(), conn.LocalAddr())
+		systemd.conns = append(systemd.conns, conn)
+		return
+	}
+	log.Warn().Msgf("systemd: activated file %s is neither listening nor datagram socket, ignored", file.Name())
+}
+
+// listener socket-activated for the address (nil: none)
+func (systemd *Systemd) listener(network, address string) net.Listener {
+	for i, listener := range systemd.listeners {
+		if matchAddr(listener.Addr(), network, address) {
+			systemd.listeners = append(systemd.listeners[:i], systemd.listeners[i+1:]...)
+			return listener
+		}
+	}
+	return nil
+}
+
+// packetConn socket-activated for the address (nil: none)
+func (systemd *Systemd) packetConn(network, address string) net.PacketConn {
+	for i, conn := range systemd.conns {
+		if matchAddr(conn.LocalAddr(), network, address) {
+			systemd.conns = append(systemd.conns[:i], systemd.conns[i+1:]...)
+			return conn
+		}
+	}
+	return nil
+}
+
+// closeUnused socket-activated listeners no endpoint is configured for
+func (systemd *Systemd) closeUnused() {
+	for _, listener := range systemd.listeners {
+		log.Warn().Msgf("systemd: no endpoint is configured for activated socket %s/%s", listener.Addr().Network(), listener.Addr())
+		listener.Close()
+	}
+	for _, conn := range systemd.conns {
+		log.Warn().Msgf("systemd: no endpoint is configured for activated socket %s/%s", conn.LocalAddr().Network(), conn.LocalAddr())
+		conn.Close()
+	}
+	systemd.listeners, systemd.conns = nil, nil
+}
+
+// matchAddr tells if socket address serves configured one: same path (unix),
+// or same port and address (socket on unspecified address serves any)
+func matchAddr(addr net.Addr, network, address string) bool {
+	switch socket := addr.(type) {
+	case *net.UnixAddr:
+		return network == "unix" && socket.Name == address
+	case *net.TCPAddr:
+		return network == "tcp" && matchIPPort(socket.IP, socket.Port, address)
+	case *net.UDPAddr:
+		return network == "udp" && matchIPPort(socket.IP, socket.Port, address)
+	}
+	return false
+}
+
+func matchIPPort(ip net.IP, port int, address string) bool {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil || portStr != strconv.Itoa(port) {
+		return false
+	}
+	return ip.IsUnspecified() || ip.Equal(net.ParseIP(host))
+}
+
+// Notify systemd (sd_notify protocol), if started with Type=notify
+func (systemd *Systemd) Notify(fields ...string) {
+	if len(systemd.socket) == 0 {
+		return
+	}
+
+	name := systemd.socket
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		log.Debug().Msgf("systemd: notify fail: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(fields, "\n"))); err != nil {
+		log.Debug().Msgf("systemd: notify fail: %v", err)
+	}
+}
+
+// Ready after initial update, with status
+func (systemd *Systemd) Ready(status string) {
+	systemd.status = status
+	systemd.Notify("READY=1", "STATUS="+status)
+}
+
+// Status update (sent only when changed)
+func (systemd *Systemd) Status(status string) {
+	if status != systemd.status {
+		systemd.status = status
+		systemd.Notify("STATUS=" + status)
+	}
+}
+
+// Watchdog keep-alive ping
+func (systemd *Systemd) Watchdog() {
+	systemd.Notify("WATCHDOG=1")
+}
+
+// Stopping on shutdown
+func (systemd *Systemd) Stopping() {
+	systemd.Notify("STOPPING=1", "STATUS=Shutting down")
+}
+
+// journalPriority maps zerolog levels to syslog priorities (sd-daemon.h)
+var journalPriority = map[zerolog.Level]int{
+	zerolog.TraceLevel: 7,
+	zerolog.DebugLevel: 7,
+	zerolog.InfoLevel:  6,
+	zerolog.WarnLevel:  4,
+	zerolog.ErrorLevel: 3,
+	zerolog.FatalLevel: 2,
+	zerolog.PanicLevel: 0,
+}
+
+// journalWriter writes plain log lines with "<priority>" prefix, which
+// journald strips and stores as the line priority
+type journalWriter struct {
+	mu      sync.Mutex
+	buffer  bytes.Buffer
+	console zerolog.ConsoleWriter
+	out     io.Writer
+}
+
+func newJournalWriter(out io.Writer) *journalWriter {
+	writer := &journalWriter{out: out}
+	writer.console = zerolog.ConsoleWriter{
+		Out:          &writer.buffer,
+		NoColor:      true,
+		PartsExclude: []string{zerolog.TimestampFieldName, zerolog.LevelFieldName},
+	}
+	return writer
+}
+
+func (writer *journalWriter) Write(p []byte) (int, error) {
+	return writer.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (writer *journalWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	priority, exists := journalPriority[level]
+	if !exists {
+		priority = 5 // notice
+	}
+
+	writer.buffer.Reset()
+	fmt.Fprintf(&writer.buffer, "<%d>", priority)
+	if _, err := writer.console.Write(p); err != nil {
+		return 0, err
+	}
+	if _, err := writer.out.Write(writer.buffer.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// journalStream tells if stderr is connected to journald
+func journalStream() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if len(stream) == 0 {
+		return false
+	}
+
+	info, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stream == fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
+
+// setupLogging for log_format option: JSON lines (default), or plain
+// lines with journald priorities (default when stderr goes to journal)
+func setupLogging(format LogFormat) {
+	if len(format) == 0 {
+		format = LogFormatJSON
+		if journalStream() {
+			format = LogFormatJournald
+		}
+	}
+
+	switch format {
+	case LogFormatJSON:
+	case LogFormatJournald:
+		log.Logger = zerolog.New(newJournalWriter(os.Stderr))
+	default:
+		log.Fatal().Msgf("unsupported log_format \"%s\" (use %s or %s)", format, LogFormatJSON, LogFormatJournald)
+	}
+}
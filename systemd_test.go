@@ -0,0 +1,167 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// notifyListener receives sd_notify datagrams on NOTIFY_SOCKET
+func notifyListener(t *testing.T, socket string) *net.UnixConn {
+	name := socket
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socket)
+	return conn
+}
+
+// notifications received until there are no more (short timeout)
+func notifications(t *testing.T, conn *net.UnixConn) []string {
+	var messages []string
+	buffer := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return messages
+		}
+		messages = append(messages, string(buffer[:n]))
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	for _, socket := range []string{
+		filepath.Join(t.TempDir(), "notify"),
+		fmt.Sprintf("@breath-test-%d", os.Getpid()), // abstract namespace
+	} {
+		conn := notifyListener(t, socket)
+		t.Setenv("WATCHDOG_USEC", "2000000")
+
+		systemd := newSystemd()
+		if systemd.watchdog != time.Second {
+			t.Errorf("%s: watchdog ping interval %v, want 1s", socket, systemd.watchdog)
+		}
+
+		systemd.Ready("1 routes")
+		systemd.Status("1 routes") // unchanged, not sent
+		systemd.Status("2 routes")
+		systemd.Watchdog()
+		systemd.Stopping()
+
+		want := []string{
+			"READY=1\nSTATUS=1 routes",
+			"STATUS=2 routes",
+			"WATCHDOG=1",
+			"STOPPING=1\nSTATUS=Shutting down",
+		}
+		if got := notifications(t, conn); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: notifications %q, want %q", socket, got, want)
+		}
+	}
+}
+
+func TestSystemdWatchdogPid(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"0", "", 0},
+		{"invalid", "", 0},
+		{"500000", strconv.Itoa(os.Getpid()), 250 * time.Millisecond},
+		{"500000", strconv.Itoa(os.Getpid() + 1), 0}, // other process
+	}
+
+	for _, test := range tests {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if got := newSystemd().watchdog; got != test.want {
+			t.Errorf("WATCHDOG_USEC=%s WATCHDOG_PID=%s: interval %v, want %v", test.usec, test.pid, got, test.want)
+		}
+	}
+}
+
+func TestMatchAddr(t *testing.T) {
+	tests := []struct {
+		addr    net.Addr
+		network string
+		address string
+		want    bool
+	}{
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, "udp", "127.0.0.1:53", true},
+		{&net.UDPAddr{IP: net.IPv4zero, Port: 53}, "udp", "127.0.0.1:53", true},
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, "tcp", "127.0.0.1:53", false},
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, "udp", "127.0.0.1:5353", false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 53}, "tcp", "127.0.0.1:53", false},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 53}, "tcp", "[::1]:53", true},
+		{&net.UnixAddr{Name: "/run/breath/dnstap.sock", Net: "unix"}, "unix", "/run/breath/dnstap.sock", true},
+		{&net.UnixAddr{Name: "/run/breath/dnstap.sock", Net: "unix"}, "unix", "/run/dnstap.sock", false},
+	}
+
+	for _, test := range tests {
+		if got := matchAddr(test.addr, test.network, test.address); got != test.want {
+			t.Errorf("matchAddr(%s/%s, %s, %s) = %v, want %v", test.addr.Network(), test.addr, test.network, test.address, got, test.want)
+		}
+	}
+}
+
+func TestJournalWriter(t *testing.T) {
+	var out bytes.Buffer
+	logger := zerolog.New(newJournalWriter(&out))
+
+	logger.Info().Msg("breath starts")
+	logger.Warn().Msgf("target %s is down", "vpn")
+	logger.Error().Msg("fail")
+
+	want := "<6>breath starts\n<4>target vpn is down\n<3>fail\n"
+	if out.String() != want {
+		t.Errorf("journal lines %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,470 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultTargetName is used for single (legacy) "target" option
+const DefaultTargetName = "default"
+
+// RouteProtocol tags routes installed by breath ("proto 177" in ip route),
+// so they can be adopted after restart
+const RouteProtocol = 177
+
+// GatewayAuto derives next hop from link addresses
+const GatewayAuto = "auto"
+
+func (config *TargetConfig) check(name string) error {
+	if len(config.Nexthops) > 0 {
+		return config.checkMultipath(name)
+	}
+	if len(config.Name) == 0 || strings.Contains(config.Name, " ") {
+		msg := fmt.Sprintf("Invalid targets.%s.name (interface/link) \"%s\"", name, config.Name)
+		return errors.New(msg)
+	}
+	switch config.Type {
+	case TargetGateway:
+	case TargetWireGuard:
+		if len(config.Peer) == 0 {
+			msg := fmt.Sprintf("targets.%s.peer (public key) is required for %s target", name, config.Type)
+			return errors.New(msg)
+		}
+		if len(config.Gateway) == 0 {
+			config.Gateway = GatewayAuto
+		}
+	default:
+		msg := fmt.Sprintf("Unsupported targets.%s.type \"%s\"", name, config.Type)
+		return errors.New(msg)
+	}
+	if len(config.Gateway) == 0 || strings.Contains(config.Gateway, "/") ||
+		(config.Gateway != GatewayAuto && net.ParseIP(config.Gateway) == nil) {
+		msg := fmt.Sprintf("Invalid targets.%s.gateway (IP): %s", name, config.Gateway)
+		return errors.New(msg)
+	}
+	if config.Health != nil {
+		if err := config.Health.init(config); err != nil {
+			return fmt.Errorf("targets.%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// linkTargets resolves fallback target names
+func linkTargets(targets map[string]*RouteTarget, configs map[string]*TargetConfig) {
+	for name, config := range configs {
+		for _, fallback := range config.Fallback {
+			other, exists := targets[fallback]
+			if !exists || fallback == name {
+				log.Fatal().Msgf("targets.%s: invalid fallback target \"%s\"", name, fallback)
+			}
+			targets[name].fallback = append(targets[name].fallback, other)
+		}
+		if len(config.Fallback) > 0 && config.Health == nil {
+			log.Warn().Msgf("targets.%s: fallback is not effective without health check", name)
+		}
+	}
+}
+
+// newRouteTarget looks up the link and parses gateway
+func newRouteTarget(name string, config *TargetConfig) *RouteTarget {
+	target := &RouteTarget{
+		name:    name,
+		metric:  config.Metric,
+		health:  config.Health,
+		healthy: true,
+		kind:    unix.RTN_UNICAST,
+		nsName:  config.Netns,
+	}
+
+	var err error
+
+	target.netns, err = openNetns(config.Netns)
+	if err != nil {
+		log.Fatal().Msgf("targets.%s: %v", name, err)
+	}
+	target.handle, err = netlink.NewHandleAt(target.netns)
+	if err != nil {
+		log.Fatal().Msgf("targets.%s: netlink socket fail: %v", name, err)
+	}
+
+	if len(config.Nexthops) > 0 {
+		target.newNexthops(config)
+		return target
+	}
+
+	target.link, err = target.handle.LinkByName(config.Name)
+	if err != nil {
+		msg := fmt.Sprintf("targets.%s: link lookup fail for link/iface \"%s\": %v", name, config.Name, err)
+		if err == netlink.ErrNotImplemented {
+			msg += ". Netlink library reported no-support for effective environment or operating system."
+		}
+		log.Fatal().Msg(msg)
+	}
+
+	if config.Type == TargetWireGuard {
+		target.wireguard, err = newWgPeer(config.Name, config.Peer)
+		if err != nil {
+			log.Fatal().Msgf("targets.%s: %v", name, err)
+		}
+		target.findLeftovers()
+	}
+
+	target.linkUp = linkIsUp(target.link)
+	if !target.linkUp {
+		log.Warn().Msgf("targets.%s: link %s is down", name, config.Name)
+	}
+
+	if config.Gateway == GatewayAuto {
+		target.autoGateway = true
+		target.gw = target.linkGateway(target.link)
+		return target
+	}
+
+	target.gw = net.ParseIP(config.Gateway)
+	if target.gw == nil {
+		log.Fatal().Msgf("targets.%s: failed to parse gateway address \"%s\"", name, config.Gateway)
+	}
+
+	return target
+}
+
+// findLeftovers of previous run: destinations of tagged routes on the
+// WireGuard link are AllowedIPs added by breath, not static ones
+func (target *RouteTarget) findLeftovers() {
+	routes, err := target.handle.RouteListFiltered(netlink.FAMILY_V4,
+		&netlink.Route{LinkIndex: target.link.Attrs().Index, Protocol: RouteProtocol},
+		netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		log.Error().Msgf("targets.%s: unable to list routes of %s: %v", target.name, target.link.Attrs().Name, err)
+		return
+	}
+	for _, route := range routes {
+		if route.Dst != nil {
+			target.wireguard.leftover(route.Dst)
+		}
+	}
+}
+
+// linkGateway derives next hop from link addresses: point-to-point peer
+// address, or none (device route) when the link has no peer
+func (target *RouteTarget) linkGateway(link netlink.Link) net.IP {
+	addrs, err := target.handle.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		log.Error().Msgf("targets.%s: unable to list addresses of %s: %v", target.name, link.Attrs().Name, err)
+		return nil
+	}
+
+	for _, addr := range addrs {
+		if addr.Peer != nil && !addr.Peer.IP.Equal(addr.IP) {
+			return addr.Peer.IP
+		}
+	}
+
+	if link.Attrs().Flags&net.FlagPointToPoint == 0 {
+		log.Warn().Msgf("targets.%s: link %s has no peer address and is not point-to-point, using device routes",
+			target.name, link.Attrs().Name)
+	}
+	return nil
+}
+
+func (target *RouteTarget) mkRoute(ip *net.IPNet) netlink.Route {
+	if target.kind != unix.RTN_UNICAST {
+		return netlink.Route{
+			Dst:      ip,
+			Type:     target.kind,
+			Priority: target.metric,
+			Protocol: RouteProtocol,
+		}
+	}
+
+	if len(target.nexthops) > 0 {
+		return target.mkMultipath(ip)
+	}
+
+	if target.gw == nil {
+		return netlink.Route{
+			LinkIndex: target.link.Attrs().Index,
+			Dst:       ip,
+			Scope:     netlink.SCOPE_LINK,
+			Priority:  target.metric,
+			Protocol:  RouteProtocol,
+		}
+	}
+
+	return netlink.Route{
+		LinkIndex: target.link.Attrs().Index,
+		Dst:       ip,
+		Gw:        target.gw,
+		Priority:  target.metric,
+		Protocol:  RouteProtocol,
+		Flags:     int(netlink.FLAG_ONLINK),
+	}
+}
+
+// describe route the way "ip route" does
+func (target *RouteTarget) describe(ip *net.IPNet) string {
+	switch target.kind {
+	case unix.RTN_BLACKHOLE:
+		return fmt.Sprintf("blackhole %s", ip)
+	case unix.RTN_UNREACHABLE:
+		return fmt.Sprintf("unreachable %s", ip)
+	}
+	if len(target.nexthops) > 0 {
+		return target.describeMultipath(ip)
+	}
+	if target.gw == nil {
+		return fmt.Sprintf("%s dev %s", ip, target.linkName())
+	}
+	return fmt.Sprintf("%s via %s dev %s onlink", ip, target.gw, target.linkName())
+}
+
+func (target *RouteTarget) addRoute(ip *net.IPNet) {
+	log.Info().Msgf("ROUTE ADD: %s", target.describe(ip))
+	if target.wireguard != nil {
+		target.wireguard.add(ip)
+	}
+	route := target.mkRoute(ip)
+	if err := target.handle.RouteAdd(&route); err != nil {
+		log.Error().Msgf("route_add fail (%s): %v", target.describe(ip), err)
+	}
+}
+
+func (target *RouteTarget) rmRoute(ip *net.IPNet) {
+	log.Info().Msgf("ROUTE DEL: %s", target.describe(ip))
+	if target.wireguard != nil {
+		target.wireguard.remove(ip)
+	}
+	route := target.mkRoute(ip) // tagged: routes of admin are never matched
+	if err := target.handle.RouteDel(&route); err != nil {
+		if err == unix.ESRCH {
+			// kernel removes routes of the link going down, or gateway becoming unreachable
+			log.Debug().Msgf("route_del (%s): route is already gone", target.describe(ip))
+			return
+		}
+		log.Error().Msgf("route_del fail (%s): %v", target.describe(ip), err)
+	}
+}
+
+// owns tells if existing route could be installed by the target:
+// kill switch and multipath routes carry the protocol tag, gateway
+// routes match link, gateway and metric (untagged host routes, added
+// by older versions, are "proto boot")
+func (target *RouteTarget) owns(route netlink.Route) bool {
+	if route.Dst == nil || route.Type != target.kind || route.Priority != target.metric {
+		return false
+	}
+
+	switch {
+	case target.kind != unix.RTN_UNICAST:
+		return route.Protocol == RouteProtocol
+	case len(target.nexthops) > 0:
+		if route.Protocol != RouteProtocol || len(route.MultiPath) == 0 {
+			return false
+		}
+		for _, info := range route.MultiPath {
+			if !target.hasNexthop(info.LinkIndex) {
+				return false
+			}
+		}
+		return true
+	default:
+		switch route.Protocol {
+		case RouteProtocol:
+		case unix.RTPROT_BOOT:
+			if ones, bits := route.Dst.Mask.Size(); ones != bits {
+				return false // untagged prefixes are likely static routes of admin
+			}
+		default:
+			return false
+		}
+		return target.link != nil && route.LinkIndex == target.link.Attrs().Index &&
+			route.Gw.Equal(target.gw)
+	}
+}
+
+// usable target has its link up and passes health checks
+func (target *RouteTarget) usable() bool {
+	return target.healthy && target.linkUp
+}
+
+// newKillSwitch makes pseudo-target for blackhole/unreachable routes
+// in the namespace of the target
+func newKillSwitch(kind KillSwitch, of *RouteTarget) *RouteTarget {
+	target := &RouteTarget{
+		name:    string(kind),
+		netns:   of.netns,
+		nsName:  of.nsName,
+		handle:  of.handle,
+		metric:  of.metric,
+		healthy: true,
+		linkUp:  true,
+		kind:    unix.RTN_BLACKHOLE,
+	}
+	if kind == KillSwitchUnreachable {
+		target.kind = unix.RTN_UNREACHABLE
+	}
+	return target
+}
+
+// linkIsUp tells if link is administratively up and operational
+// (tun devices report "unknown" operational state)
+func linkIsUp(link netlink.Link) bool {
+	attrs := link.Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return false
+	}
+	return attrs.OperState == netlink.OperUp || attrs.OperState == netlink.OperUnknown
+}
+
+// Tell link (interface) name from internal pointer
+func (target *RouteTarget) linkName() string {
+	if target.link != nil {
+		if as := target.link.Attrs(); as != nil {
+			if len(as.Name) > 0 {
+				return as.Name
+			}
+		}
+	}
+
+	return "link-noname"
+}
+
+// subscriptionError logs netlink subscription errors, except on Stop
+func (state *State) subscriptionError(subscription string) func(error) {
+	return func(err error) {
+		select {
+		case <-state.ctx.Done():
+		default:
+			log.Error().Msgf("%s: %v", subscription, err)
+		}
+	}
+}
+
+// watchLinks tracks state of target links until Stop. Routes of a target
+// whose link is down (or removed) move to fallback targets (or kill switch),
+// and move back when the link is up again. With "gateway: auto", gateway
+// is re-evaluated on address changes.
+func (state *State) watchLinks() {
+	namespaces := make(map[string][]*RouteTarget)
+	for _, target := range state.helper.targets {
+		namespaces[target.nsName] = append(namespaces[target.nsName], target)
+	}
+
+	for _, targets := range namespaces {
+		targets := targets
+		state.goroutine(func() {
+			state.watchNamespace(targets)
+		})
+	}
+}
+
+// watchNamespace tracks links of the targets from single network namespace
+func (state *State) watchNamespace(targets []*RouteTarget) {
+	ns := targets[0].netns
+
+	updates := make(chan netlink.LinkUpdate, 16)
+	err := netlink.LinkSubscribeWithOptions(updates, state.ctx.Done(), netlink.LinkSubscribeOptions{
+		Namespace:     &ns,
+		ErrorCallback: state.subscriptionError("Link state subscription"),
+	})
+	if err != nil {
+		log.Error().Msgf("Unable to track link state: %v", err)
+		return
+	}
+
+	var addrUpdates chan netlink.AddrUpdate
+	for _, target := range targets {
+		if target.autoGateway {
+			addrUpdates = make(chan netlink.AddrUpdate, 16)
+			err = netlink.AddrSubscribeWithOptions(addrUpdates, state.ctx.Done(), netlink.AddrSubscribeOptions{
+				Namespace:     &ns,
+				ErrorCallback: state.subscriptionError("Address subscription"),
+			})
+			if err != nil {
+				log.Error().Msgf("Unable to track link addresses (gateway: auto): %v", err)
+				addrUpdates = nil
+			}
+			break
+		}
+	}
+
+	for {
+		select {
+		case <-state.ctx.Done():
+			// subscriptions close their sockets, which does not interrupt pending reads
+			return
+		case update, more := <-updates:
+			if !more {
+				return
+			}
+
+			name := update.Attrs().Name
+			up := update.Header.Type != unix.RTM_DELLINK && linkIsUp(update.Link)
+
+			for _, target := range targets {
+				for _, hop := range target.nexthops {
+					if hop.link.Attrs().Name == name {
+						state.helper.SetNexthop(target, hop, update.Link, up)
+					}
+				}
+				if target.link != nil && target.link.Attrs().Name == name {
+					state.helper.SetLink(target, update.Link, up)
+					if target.autoGateway && up {
+						state.helper.SetGateway(target, target.linkGateway(update.Link))
+					}
+				}
+			}
+		case update, more := <-addrUpdates:
+			if !more {
+				addrUpdates = nil
+				continue
+			}
+
+			for _, target := range targets {
+				if target.autoGateway && target.link.Attrs().Index == update.LinkIndex {
+					state.helper.SetGateway(target, target.linkGateway(target.link))
+				}
+			}
+		}
+	}
+}
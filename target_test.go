@@ -0,0 +1,267 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestRouteTargetOwns(t *testing.T) {
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "vpn0", Index: 5}}
+	target := &RouteTarget{
+		name:   "vpn",
+		link:   link,
+		gw:     net.IPv4(10, 8, 0, 1),
+		metric: 100,
+		kind:   unix.RTN_UNICAST,
+	}
+
+	route := func(cidr string, protocol int) netlink.Route {
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return netlink.Route{
+			LinkIndex: 5,
+			Dst:       dst,
+			Gw:        net.IPv4(10, 8, 0, 1),
+			Priority:  100,
+			Type:      unix.RTN_UNICAST,
+			Protocol:  protocol,
+		}
+	}
+
+	otherGateway := route("203.0.113.1/32", RouteProtocol)
+	otherGateway.Gw = net.IPv4(10, 8, 0, 2)
+	otherMetric := route("203.0.113.1/32", RouteProtocol)
+	otherMetric.Priority = 0
+
+	tests := []struct {
+		name  string
+		route netlink.Route
+		want  bool
+	}{
+		{"tagged host route", route("203.0.113.1/32", RouteProtocol), true},
+		{"tagged prefix", route("203.0.113.0/24", RouteProtocol), true},
+		{"untagged host route", route("203.0.113.1/32", unix.RTPROT_BOOT), true},
+		{"untagged prefix", route("203.0.113.0/24", unix.RTPROT_BOOT), false},
+		{"static protocol", route("203.0.113.1/32", unix.RTPROT_STATIC), false},
+		{"other gateway", otherGateway, false},
+		{"other metric", otherMetric, false},
+	}
+
+	for _, test := range tests {
+		if got := target.owns(test.route); got != test.want {
+			t.Errorf("%s: owns %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// newTestNetns makes network namespace with loopback up (test is skipped
+// without privileges), returning netlink handle in it and loopback link
+func newTestNetns(t *testing.T) (netns.NsHandle, *netlink.Handle, netlink.Link) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("network namespaces: %v", err)
+	}
+	defer origin.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("network namespaces: %v", err)
+	}
+	if err := netns.Set(origin); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(handle.Delete)
+
+	link, err := handle.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handle.LinkSetUp(link); err != nil {
+		t.Fatal(err)
+	}
+	return ns, handle, link
+}
+
+// newTestTarget with device routes via loopback of the namespace
+func newTestTarget(t *testing.T, name string, metric int) *RouteTarget {
+	ns, handle, link := newTestNetns(t)
+	return &RouteTarget{
+		name:    name,
+		netns:   ns,
+		handle:  handle,
+		link:    link,
+		metric:  metric,
+		healthy: true,
+		linkUp:  true,
+		kind:    unix.RTN_UNICAST,
+	}
+}
+
+// kernelRoutes of the target namespace: destination -> protocol
+func kernelRoutes(t *testing.T, target *RouteTarget) map[string]int {
+	routes, err := target.handle.RouteListFiltered(netlink.FAMILY_V4,
+		&netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protocols := make(map[string]int)
+	for _, route := range routes {
+		if route.Dst != nil {
+			protocols[route.Dst.String()] = route.Protocol
+		}
+	}
+	return protocols
+}
+
+func TestReleaseUntaggedAdopted(t *testing.T) {
+	target := newTestTarget(t, "vpn", 100)
+	for _, cidr := range []string{"203.0.113.1/32", "203.0.113.2/32"} {
+		_, dst, _ := net.ParseCIDR(cidr)
+		route := target.mkRoute(dst)
+		route.Protocol = unix.RTPROT_BOOT // added by older version
+		if err := target.handle.RouteAdd(&route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var helper RouteHelper
+	helper.Reset(map[string]*RouteTarget{"vpn": target})
+	helper.Assign(0, "vpn", 0, KillSwitchOff)
+
+	helper.Adopt()
+	_, wanted, _ := net.ParseCIDR("203.0.113.1/32")
+	helper.Replace(0, []*net.IPNet{wanted})
+	helper.ReleaseAdopted()
+
+	routes := kernelRoutes(t, target)
+	if protocol, exists := routes["203.0.113.1/32"]; !exists || protocol != RouteProtocol {
+		t.Errorf("wanted route: installed %v, protocol %d", exists, protocol)
+	}
+	if _, exists := routes["203.0.113.2/32"]; exists {
+		t.Errorf("route no longer wanted is left in place")
+	}
+	if count, _ := helper.Count(); count != 1 {
+		t.Errorf("%d routes in the table, want 1", count)
+	}
+}
+
+func TestMoveUntaggedAdopted(t *testing.T) {
+	target := newTestTarget(t, "vpn", 100)
+	_, dst, _ := net.ParseCIDR("203.0.113.1/32")
+	route := target.mkRoute(dst)
+	route.Protocol = unix.RTPROT_BOOT
+	if err := target.handle.RouteAdd(&route); err != nil {
+		t.Fatal(err)
+	}
+
+	var helper RouteHelper
+	helper.Reset(map[string]*RouteTarget{"vpn": target})
+	helper.Assign(0, "vpn", 0, KillSwitchBlackhole)
+
+	helper.Adopt()
+	helper.SetHealth(target, false) // adopted route with no owners stays
+	if _, exists := kernelRoutes(t, target)["203.0.113.1/32"]; !exists {
+		t.Fatal("adopted route is deleted before release")
+	}
+
+	helper.Replace(0, []*net.IPNet{dst})
+	helper.ReleaseAdopted()
+
+	onLink, err := target.handle.RouteListFiltered(netlink.FAMILY_V4,
+		&netlink.Route{LinkIndex: target.link.Attrs().Index, Dst: dst}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onLink) > 0 {
+		t.Errorf("route is left on the link of unhealthy target")
+	}
+	if protocol := kernelRoutes(t, target)["203.0.113.1/32"]; protocol != RouteProtocol {
+		t.Errorf("kill switch route protocol %d, want %d", protocol, RouteProtocol)
+	}
+}
+
+// recordingExporter keeps the last exported route table
+type recordingExporter struct {
+	routes []ExportedRoute
+}
+
+func (exporter *recordingExporter) Export(routes []ExportedRoute) {
+	exporter.routes = routes
+}
+
+func TestFailoverExport(t *testing.T) {
+	primary := newTestTarget(t, "primary", 100)
+	backup := newTestTarget(t, "backup", 100)
+
+	var helper RouteHelper
+	helper.Reset(map[string]*RouteTarget{"primary": primary, "backup": backup})
+	helper.Assign(0, "primary", 10, KillSwitchOff)
+	helper.Assign(1, "backup", 0, KillSwitchOff)
+
+	exporter := &recordingExporter{}
+	helper.AddExporter(exporter)
+
+	_, dst, _ := net.ParseCIDR("203.0.113.1/32")
+	helper.Add(0, dst, false)
+	helper.Add(1, dst, false)
+	helper.StartExports()
+	if len(exporter.routes) != 1 || exporter.routes[0].Winner != 0 {
+		t.Fatalf("exported %+v, want winner 0", exporter.routes)
+	}
+
+	exporter.routes = nil
+	helper.SetHealth(primary, false)
+	if len(exporter.routes) != 1 || exporter.routes[0].Winner != 1 {
+		t.Errorf("exported after failover %+v, want winner 1", exporter.routes)
+	}
+}
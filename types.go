@@ -34,10 +34,14 @@
 package main
 
 import (
+	"context"
 	"net"
+	"sync"
 	"time"
 
+	dns_impl "github.com/miekg/dns"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 )
 
 // ConfigChecker is usable for YAML file validation before loading Config
@@ -47,18 +51,120 @@ type ConfigChecker struct {
 
 // Config is an input data layout
 type Config struct {
-	DefaultResolver *Resolver `yaml:"default_resolver,flow"`
-	Target          struct {
-		Name, Gateway string
-		Metric        int
-	}
-	Sources []struct {
-		Interval string
-		Domains  []string  `yaml:",flow"`
-		Resolver *Resolver `yaml:",flow"`
+	DefaultResolver *Resolver                `yaml:"default_resolver,flow"`
+	Forwarder       *Forwarder               `yaml:",flow"`
+	Sniffer         *Sniffer                 `yaml:",flow"`
+	Dnstap          *DnstapListener          `yaml:",flow"`
+	QueryLog        *QueryLog                `yaml:"query_log,flow"`
+	OpenVPNPush     *OpenVPNPush             `yaml:"openvpn_push,flow"`
+	Exports         []*RouteExport           `yaml:",flow"`
+	BGP             *BGPSpeaker              `yaml:"bgp,flow"`
+	OnExit          OnExit                   `yaml:"on_exit"`
+	ShutdownTimeout string                   `yaml:"shutdown_timeout"`
+	LogFormat       LogFormat                `yaml:"log_format"`
+	Target          *TargetConfig            `yaml:",flow"`
+	Targets         map[string]*TargetConfig `yaml:",flow"`
+	Sources         []struct {
+		Interval     string
+		Jitter       string
+		Samples      int    // queries of each domain per update
+		SampleWindow string `yaml:"sample_window"` // queries are spread over the window
+		Retain       string // addresses stay routed this long after last seen
+		Target       string
+		Priority     int
+		KillSwitch   KillSwitch       `yaml:"kill_switch"`
+		Domains      []string         `yaml:",flow"`
+		GeoIP        *GeoIPSource     `yaml:"geoip,flow"`
+		Resolver     *Resolver        `yaml:",flow"`
+		BGP          *BGPAnnouncement `yaml:"bgp,flow"`
 	} `yaml:",flow"`
 }
 
+// TargetConfig is a link (interface) with gateway to route through
+type TargetConfig struct {
+	Name, Gateway string
+	Metric        int
+	Type          string
+	Peer          string           // WireGuard peer public key
+	Netns         string           // network namespace name or path
+	Health        *HealthCheck     `yaml:",flow"`
+	Fallback      []string         `yaml:",flow"` // targets to use (in order) while unhealthy
+	Nexthops      []*NexthopConfig `yaml:",flow"` // ECMP: spread routes over several links/gateways
+}
+
+// NexthopConfig is a link and gateway of multipath target with its weight
+type NexthopConfig struct {
+	Name, Gateway string
+	Weight        int
+}
+
+// HealthCheck probes the target through its link (ICMP echo or TCP connect)
+type HealthCheck struct {
+	Probe     string
+	Address   string
+	Interval  string
+	Timeout   string
+	Threshold int
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// GeoIPSource selects networks by country from a local MaxMind database
+// (e.g. GeoLite2-Country.mmdb). With Invert, all networks except
+// the listed countries are used.
+type GeoIPSource struct {
+	Database  string
+	Countries []string `yaml:",flow"`
+	Invert    bool
+	Aggregate bool
+}
+
+// KillSwitch is a route type replacing group routes while no target
+// is usable, so that traffic never leaves via default gateway
+type KillSwitch string
+
+const (
+	// KillSwitchOff removes routes (traffic goes via default gateway)
+	KillSwitchOff KillSwitch = ""
+	// KillSwitchBlackhole silently discards traffic
+	KillSwitchBlackhole KillSwitch = "blackhole"
+	// KillSwitchUnreachable rejects traffic with ICMP host unreachable
+	KillSwitchUnreachable KillSwitch = "unreachable"
+)
+
+// OnExit tells what happens to routes when breath exits
+type OnExit string
+
+const (
+	// OnExitFlush deletes all routes (default)
+	OnExitFlush OnExit = "flush"
+	// OnExitKeep leaves routes in place
+	OnExitKeep OnExit = "keep"
+)
+
+// Strategy of using resolver nameservers
+type Strategy string
+
+const (
+	// StrategyFirst asks nameservers in order, until one answers (default)
+	StrategyFirst Strategy = "first"
+	// StrategyUnion asks all nameservers in parallel and routes all answers
+	StrategyUnion Strategy = "union"
+	// StrategyRace asks all nameservers in parallel, the fastest answer wins
+	StrategyRace Strategy = "race"
+)
+
+// LogFormat of log lines on stderr
+type LogFormat string
+
+const (
+	// LogFormatJSON writes zerolog JSON lines
+	LogFormatJSON LogFormat = "json"
+	// LogFormatJournald writes plain lines with journald priority prefixes
+	LogFormatJournald LogFormat = "journald"
+)
+
 // FailAction support is not ready (TODO)
 type FailAction string
 
@@ -73,18 +179,201 @@ const (
 // Resolver performs DNS resolution with options. Each group can use
 // default_resolver, or define its own resolver.
 type Resolver struct {
-	NameServers   []string   `yaml:"nameservers,flow"`
-	NameServersIP []net.IP   `yaml:"-"`
-	ActionOnFail  FailAction `yaml:"on_failure"`
+	NameServers   []string     `yaml:"nameservers,flow"`
+	NameServersIP []net.IP     `yaml:"-"`
+	ActionOnFail  FailAction   `yaml:"on_failure"`
+	Netns         string       `yaml:"netns"` // resolve inside network namespace
+	Retry         *RetryPolicy `yaml:",flow"`
+	Network       string       // udp (default, TCP on truncated reply) or tcp
+	Timeout       string       // of each query
+	UDPSize       uint16       `yaml:"udp_size"` // EDNS0 buffer size
+	Strategy      Strategy     // how nameservers are used to resolve domains
+
+	ns      netns.NsHandle
+	timeout time.Duration
+}
+
+// Resolution of domain name: addresses of the last name in CNAME chain
+type Resolution struct {
+	IPs   []net.IP
+	Chain []string // queried name, then CNAME targets (normalized; union: names of all chains)
+	TTL   uint32   // minimum TTL of chain records
+
+	Provenance map[string][]net.IP // answer of each nameserver used, for debugging
+}
+
+// RetryPolicy makes failing domains retried sooner than group interval:
+// first after backoff, doubling on each consecutive failure up to
+// max_backoff, plus random jitter
+type RetryPolicy struct {
+	Attempts   int // fast retries before falling back to interval (0: unlimited)
+	Backoff    string
+	MaxBackoff string `yaml:"max_backoff"`
+	Jitter     string
+
+	backoff    time.Duration
+	maxBackoff time.Duration
+	jitter     time.Duration
+}
+
+// Forwarder is an optional DNS server proxying client queries to group
+// resolvers. Routes for matching answers are installed before the reply
+// is sent to the client, and expire after TTL plus grace period.
+type Forwarder struct {
+	Listen   string
+	Grace    string
+	Resolver *Resolver `yaml:",flow"`
+
+	grace   time.Duration
+	state   *State
+	servers []*dns_impl.Server
+}
+
+// Sniffer passively captures DNS responses (UDP) on the interface, or
+// replays a pcap file, to learn addresses of group domains
+type Sniffer struct {
+	Interface string
+	Pcap      string
+	Grace     string
+
+	grace  time.Duration
+	source packetSource
+}
+
+// DnstapListener receives dnstap frames from a resolver (Unbound, CoreDNS)
+// over Unix socket and learns from client responses
+type DnstapListener struct {
+	Socket string
+	Grace  string
+
+	grace  time.Duration
+	socket net.Listener
+}
+
+// QueryLog follows resolver log file (dnsmasq log-queries, unbound
+// log-replies) to learn addresses of group domains
+type QueryLog struct {
+	Path   string
+	Format string
+	TTL    string // logs do not tell record TTL
+	Grace  string
+
+	ttl      time.Duration
+	grace    time.Duration
+	resolved map[string]time.Time // unbound format: recently resolved names
+}
+
+// OpenVPNPush writes routed destinations as OpenVPN server "push route"
+// directives to a client-config-dir file (or a config include), optionally
+// signalling the server through its management interface
+type OpenVPNPush struct {
+	File       string
+	Management string // host:port, or unix socket path
+	Password   string // management interface password
+	Signal     string // thrown on file change (default SIGUSR1)
+	// SignalInterval is a minimum time between signals (changes are batched)
+	SignalInterval string `yaml:"signal_interval"`
+
+	signalInterval time.Duration
+	mu             sync.Mutex
+	pending        []byte        // content to write (nil: written)
+	written        []byte        // last written file content
+	notify         chan struct{} // content changed, write pending
+}
+
+// BGPSpeaker announces routed destinations to a BGP peer (upstream router)
+// over an embedded BGP-4 session, as an alternative to netlink routes
+type BGPSpeaker struct {
+	Peer        string   // address, or host:port
+	LocalAS     uint32   `yaml:"local_as"`
+	PeerAS      uint32   `yaml:"peer_as"`
+	RouterID    string   `yaml:"router_id"`
+	HoldTime    string   `yaml:"hold_time"`
+	NextHop     string   `yaml:"next_hop"`
+	Communities []string `yaml:",flow"`
+
+	routerID net.IP
+	holdTime time.Duration
+	defaults *bgpAttributes
+	groups   map[GroupID]*bgpAttributes // groups with own next hop or communities
+
+	mu      sync.Mutex
+	desired map[ipstr]bgpRoute // announcements wanted by the route table
+	notify  chan struct{}
+}
+
+// BGPAnnouncement overrides next hop or communities for the group routes
+type BGPAnnouncement struct {
+	NextHop     string   `yaml:"next_hop"`
+	Communities []string `yaml:",flow"`
+}
+
+// RouteExport renders the route table for devices breath does not run on
+// (RouterOS script, OpenWrt uci commands, pf table) to a file or stdout,
+// as full snapshots or changes since previous export
+type RouteExport struct {
+	Format    string
+	Mode      string
+	File      string // empty or "-": stdout
+	Gateway   string // routeros, uci
+	Interface string // uci logical interface
+	Table     string // pf table
+	State     string // incremental: destinations of previous run
+
+	format   exportFormat
+	written  []byte
+	previous map[ipstr]*net.IPNet
+	exported bool // incremental: changes of this run are written
+
+	mu           sync.Mutex
+	pending      []byte        // content to write (nil: written)
+	pendingState []byte        // incremental: state file content to write
+	notify       chan struct{} // content changed, write pending
 }
 
 // State is an expanded configuration
 type State struct {
-	groups  []Group
-	tickers []*time.Ticker // timeouts/intervals triggering updates for master channel
-	master  chan *Group    // outer interface to listen for updates
-	quit    chan struct{}  // send stop signal and interrupt background loop
-	helper  RouteHelper
+	groups    []Group
+	scheduler *Scheduler         // next run times of group domains
+	master    chan Task          // outer interface to listen for updates
+	ctx       context.Context    // cancelled on Stop: interrupts scheduler, DNS queries and listeners
+	cancel    context.CancelFunc // Stop
+	wg        sync.WaitGroup     // background goroutines, waited for on Cleanup
+	helper    RouteHelper
+
+	onExit          OnExit
+	shutdownTimeout time.Duration // limits waiting for goroutines on Cleanup
+
+	domains   *domainTrie // lookup tree for names observed in DNS traffic
+	forwarder *Forwarder
+	sniffer   *Sniffer
+	dnstap    *DnstapListener
+	queryLog  *QueryLog
+
+	openvpnPush *OpenVPNPush
+	exports     []*RouteExport
+	bgp         *BGPSpeaker
+
+	systemd *Systemd
+}
+
+// Systemd notifications (Type=notify service) and socket-activated
+// listeners, inactive when breath is not started by systemd
+type Systemd struct {
+	socket    string        // NOTIFY_SOCKET
+	watchdog  time.Duration // WATCHDOG=1 interval (0: disabled)
+	status    string        // last STATUS sent
+	listeners []net.Listener
+	conns     []net.PacketConn
+}
+
+// Task is a scheduled update: domain of the group, or GeoIP networks
+// of the group (empty domain). Further samples of the domain within
+// an update are one-shot tasks (Sample > 0).
+type Task struct {
+	Group  *Group
+	Domain string
+	Sample int
 }
 
 // GroupID is an index of group, used as an identifier
@@ -96,21 +385,110 @@ type Group struct {
 	config   *Config
 	index    GroupID
 	interval time.Duration
+	jitter   time.Duration // maximum random delay added to interval
 	resolver *Resolver
+	target   string   // name of the target in config targets
+	domains  []string // names resolved on update (patterns excluded)
+	patterns int      // number of patterns, matched on names from DNS traffic
+
+	samples      int           // queries of each domain per update (rotating answers)
+	sampleWindow time.Duration // samples are spread over the window
+	retain       time.Duration // sighting window of addresses (0: last result only)
+
+	resolved  map[string][]net.IP            // last resolution result of each domain
+	failures  map[string]int                 // consecutive resolution failures of each domain
+	sightings map[string]map[string]sighting // addresses seen within retain window, by domain
+	rounds    map[string]*samplingRound      // answers of samples within current (or last) update, by domain
+	networks  []*net.IPNet                   // last GeoIP networks
+}
+
+// samplingRound accumulates answers of domain samples within an update
+type samplingRound struct {
+	result   Resolution
+	answered int
+	previous []net.IP // answers of previous round, routed until this round completes
+}
+
+// sighting of domain address, routed until retain window passes
+type sighting struct {
+	ip   net.IP
+	seen time.Time
 }
 
-type ipstr string
+type ipstr string // route destination key (CIDR notation)
 type routeData struct {
-	dst    *net.IPNet
-	owners map[GroupID]int
+	dst      *net.IPNet
+	owners   map[GroupID]int
+	learned  map[GroupID]time.Time // expiration of routes learned from DNS traffic
+	target   *RouteTarget          // where route is installed (nil: not installed)
+	winner   GroupID               // owner whose target is used, as last synced
+	adopted  bool                  // left by previous run, kept until first update completes
+	untagged bool                  // adopted without protocol tag (tagged once wanted)
+}
+type routesMap map[ipstr]*routeData
+
+// ExportedRoute is a destination from the route table with groups wanting it
+type ExportedRoute struct {
+	Dst    *net.IPNet
+	Owners []GroupID
+	Winner GroupID // owner whose target is used for the route
+}
+
+// RouteExporter is an output of the route table other than netlink routes.
+// Export is called with the whole table after changes of destinations or
+// their owners. Helper is locked meanwhile, so Export must not block.
+type RouteExporter interface {
+	Export(routes []ExportedRoute)
+}
+
+// RouteTarget is a link and gateway routes are installed through
+type RouteTarget struct {
+	name   string          // name in config "targets"
+	netns  netns.NsHandle  // namespace of the link (None: breath namespace)
+	nsName string          // namespace name or path from config
+	handle *netlink.Handle // netlink socket in the namespace
+	link   netlink.Link    // target device
+	gw     net.IP          // target gateway
+	metric int             // route metric
+
+	health   *HealthCheck
+	fallback []*RouteTarget
+	healthy  bool
+	streak   int // consecutive probe results contradicting current health state
+	linkUp   bool
+	kind     int // route type: unicast via gateway, or kill switch (blackhole/unreachable)
+
+	autoGateway bool    // gateway is derived from link addresses (nil gw: device route)
+	wireguard   *wgPeer // peer AllowedIPs are maintained with routes
+
+	nexthops []*nexthop // multipath target (no link and gateway of its own)
+}
+
+type nexthop struct {
+	link   netlink.Link
+	gw     net.IP // nil: device nexthop
+	weight int
+	up     bool
+}
+
+type groupRoute struct {
+	target     *RouteTarget
+	priority   int
+	killSwitch *RouteTarget // used when no target is usable (nil: remove routes)
 }
-type routesMap map[ipstr]routeData
 
 // RouteHelper is used to maintain routes from multiple groups with possible IP intersections
 // still gives a way to track reference count for each
 type RouteHelper struct {
-	link   netlink.Link // target device
-	gw     net.IP       // target gateway
-	metric int          // route metric
-	routes routesMap    // routes stored as: ip => owners
+	mu      sync.Mutex // routes are modified by updates and DNS listeners concurrently
+	targets map[string]*RouteTarget
+	groups  map[GroupID]groupRoute // target and priority of each group
+
+	killSwitches map[string]*RouteTarget // kill switch pseudo-targets by type and metric
+	routes       routesMap               // routes stored as: destination => owners
+
+	exporters []RouteExporter
+	exporting bool // exports are started (and not stopped by Flush)
+	changed   bool // destinations or owners changed since last export
+	closed    bool // routes are no longer added (exit)
 }
@@ -0,0 +1,193 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog/log"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Target types
+const (
+	// TargetGateway routes via gateway (or device routes)
+	TargetGateway = ""
+	// TargetWireGuard also maintains AllowedIPs of a WireGuard peer
+	TargetWireGuard = "wireguard"
+)
+
+// wgPeer keeps AllowedIPs of the peer in sync with routes through the target.
+// AllowedIPs not added by breath (static entries) are left intact.
+type wgPeer struct {
+	device    string
+	key       wgtypes.Key
+	managed   map[ipstr]net.IPNet // routes through the target
+	pushed    map[ipstr]net.IPNet // managed entries last written to the device
+	static    map[ipstr]net.IPNet // entries of the peer not added by breath (nil: peer not seen yet)
+	leftovers map[ipstr]struct{}  // destinations of tagged routes left by previous run
+	dirty     bool                // managed entries differ from pushed (commit on unlock)
+}
+
+func newWgPeer(device, publicKey string) (*wgPeer, error) {
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		msg := fmt.Sprintf("wireguard peer public key \"%s\": %v", publicKey, err)
+		return nil, errors.New(msg)
+	}
+
+	return &wgPeer{
+		device:    device,
+		key:       key,
+		managed:   make(map[ipstr]net.IPNet),
+		pushed:    make(map[ipstr]net.IPNet),
+		leftovers: make(map[ipstr]struct{}),
+	}, nil
+}
+
+// leftover destination of previous run (its entry is not static)
+func (peer *wgPeer) leftover(dst *net.IPNet) {
+	peer.leftovers[ipstr(dst.String())] = struct{}{}
+}
+
+func (peer *wgPeer) add(dst *net.IPNet) {
+	peer.managed[ipstr(dst.String())] = *dst
+	peer.dirty = true
+}
+
+func (peer *wgPeer) remove(dst *net.IPNet) {
+	delete(peer.managed, ipstr(dst.String()))
+	peer.dirty = true
+}
+
+// commit writes AllowedIPs (static entries + managed) to the peer, if changed
+func (peer *wgPeer) commit() {
+	if !peer.dirty {
+		return
+	}
+	peer.dirty = false
+
+	client, err := wgctrl.New()
+	if err != nil {
+		log.Error().Msgf("wireguard: %v", err)
+		return
+	}
+	defer client.Close()
+
+	device, err := client.Device(peer.device)
+	if err != nil {
+		log.Error().Msgf("wireguard device %s: %v", peer.device, err)
+		return
+	}
+
+	var current []net.IPNet
+	found := false
+	for _, p := range device.Peers {
+		if p.PublicKey == peer.key {
+			current, found = p.AllowedIPs, true
+			break
+		}
+	}
+	if !found {
+		log.Error().Msgf("wireguard device %s: peer %s not found", peer.device, peer.key)
+		return
+	}
+
+	peer.updateStatic(current)
+
+	allowed := make([]net.IPNet, 0, len(peer.static)+len(peer.managed))
+	for _, ipnet := range peer.static {
+		allowed = append(allowed, ipnet)
+	}
+	for key, ipnet := range peer.managed {
+		if _, isStatic := peer.static[key]; !isStatic {
+			allowed = append(allowed, ipnet)
+		}
+	}
+
+	err = client.ConfigureDevice(peer.device, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:         peer.key,
+			UpdateOnly:        true,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        allowed,
+		}},
+	})
+	if err != nil {
+		log.Error().Msgf("wireguard device %s: peer %s AllowedIPs update fail: %v", peer.device, peer.key, err)
+		peer.dirty = true
+		return
+	}
+
+	log.Debug().Msgf("wireguard device %s: peer %s has %d AllowedIPs (%d managed)",
+		peer.device, peer.key, len(allowed), len(peer.managed))
+
+	peer.pushed = make(map[ipstr]net.IPNet, len(peer.managed))
+	for key, ipnet := range peer.managed {
+		peer.pushed[key] = ipnet
+	}
+}
+
+// updateStatic entries with current AllowedIPs of the peer: on first sight,
+// all but leftovers of previous run are static. Later, entries breath did
+// not write are added, and entries removed by admin are forgotten.
+func (peer *wgPeer) updateStatic(current []net.IPNet) {
+	first := peer.static == nil
+	if first {
+		peer.static = make(map[ipstr]net.IPNet, len(current))
+	}
+
+	seen := make(map[ipstr]struct{}, len(current))
+	for _, ipnet := range current {
+		key := ipstr(ipnet.String())
+		seen[key] = struct{}{}
+		if first {
+			if _, leftover := peer.leftovers[key]; !leftover {
+				peer.static[key] = ipnet
+			}
+		} else if _, wasPushed := peer.pushed[key]; !wasPushed {
+			peer.static[key] = ipnet
+		}
+	}
+
+	for key := range peer.static {
+		if _, exists := seen[key]; !exists {
+			delete(peer.static, key)
+		}
+	}
+	peer.leftovers = nil
+}
@@ -0,0 +1,87 @@
+/**
+	* The Clear BSD License
+	*
+	* Copyright (c) 2019 Dmitrij Igorevich
+	* All rights reserved.
+	*
+	* Redistribution and use in source and binary forms, with or without
+	*	modification, are permitted (subject to the limitations in the
+	* disclaimer below) provided that the following conditions are met:
+	*
+	*		* Redistributions of source code must retain the above copyright notice,
+	*			this list of conditions and the following disclaimer.
+	*  	* Redistributions in binary form must reproduce the above copyright
+	* 		notice, this list of conditions and the following disclaimer in the
+	* 		documentation and/or other materials provided with the distribution.
+  *		* Neither the name Dmitrij Igorevich nor the names of public
+	*			contributors may be used to endorse or promote products derived from
+	*			this software without specific prior written permission.
+	*
+	* NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+	* THIS LICENSE. THIS SOFTWARE IS PROVIDED BY D. IGOREVICH AND CONTRIBUTORS
+	* "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING,
+	* BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS
+	* FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+	* HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+	* SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+	* TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA,
+	* OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+	* OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+	* NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+	* SOFTWARE,	EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"sort"
+	"testing"
+)
+
+func staticKeys(peer *wgPeer) []string {
+	keys := make([]string, 0, len(peer.static))
+	for key := range peer.static {
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestWireGuardStatic(t *testing.T) {
+	peer := &wgPeer{
+		managed:   make(map[ipstr]net.IPNet),
+		pushed:    make(map[ipstr]net.IPNet),
+		leftovers: make(map[ipstr]struct{}),
+	}
+	nets := parseNets(t, "10.0.0.0/24", "1.1.1.1/32", "2.2.2.2/32", "3.3.3.3/32")
+	current := func(idx ...int) []net.IPNet {
+		entries := make([]net.IPNet, 0, len(idx))
+		for _, i := range idx {
+			entries = append(entries, *nets[i])
+		}
+		return entries
+	}
+
+	// 2.2.2.2 is left by previous run
+	peer.leftover(nets[2])
+	peer.updateStatic(current(0, 1, 2))
+	if keys := staticKeys(peer); len(keys) != 2 || keys[0] != "1.1.1.1/32" || keys[1] != "10.0.0.0/24" {
+		t.Fatalf("static on first sight: %v", keys)
+	}
+
+	// static 1.1.1.1 is routed by breath too: it stays static
+	peer.managed["1.1.1.1/32"] = *nets[1]
+	peer.pushed["1.1.1.1/32"] = *nets[1]
+	peer.pushed["2.2.2.2/32"] = *nets[2]
+	peer.updateStatic(current(0, 1, 2))
+	if keys := staticKeys(peer); len(keys) != 2 || keys[0] != "1.1.1.1/32" || keys[1] != "10.0.0.0/24" {
+		t.Fatalf("static entry routed by breath dropped: %v", keys)
+	}
+
+	// admin adds 3.3.3.3 and removes 10.0.0.0/24
+	peer.updateStatic(current(1, 2, 3))
+	if keys := staticKeys(peer); len(keys) != 2 || keys[0] != "1.1.1.1/32" || keys[1] != "3.3.3.3/32" {
+		t.Fatalf("static after admin changes: %v", keys)
+	}
+}